@@ -0,0 +1,107 @@
+package pytricia
+
+// Aggregate returns a minimized copy of the trie that answers every
+// lookup exactly as the trie does: sibling prefixes holding equal values
+// are folded into their parent, and prefixes whose closest stored
+// ancestor holds an equal value are dropped. The trie is not modified.
+func (t *Trie[V]) Aggregate(equal func(a, b V) bool) *Trie[V] {
+	return t.load().Aggregate(equal)
+}
+
+// Aggregate: Trie.Aggregate, returning the copy as a PyTricia.
+func (t *PyTricia) Aggregate(equal func(a, b any) bool) *PyTricia {
+	return pyTricia(t.Trie.Aggregate(equal))
+}
+
+// AggregateInPlace: Aggregate applied to the trie itself, as one write.
+// Subscribers see an event for every prefix it adds, drops or changes.
+func (t *Trie[V]) AggregateInPlace(equal func(a, b V) bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	cur := t.load()
+	next := cur.aggregate(equal)
+	t.root.Store(next)
+	if len(t.subs) == 0 {
+		return
+	}
+	for _, ipType := range [2]int{4, 6} {
+		for _, ev := range changes(cur.root(ipType), next.root(ipType), ipType, equal) {
+			t.notify(ev)
+		}
+	}
+}
+
+// Aggregate returns a minimized copy of the trie; see Trie.Aggregate.
+func (tr *tree[V]) Aggregate(equal func(a, b V) bool) *Trie[V] {
+	t := &Trie[V]{}
+	t.root.Store(tr.aggregate(equal))
+	return t
+}
+
+// aggregate builds the minimized version: siblings are folded bottom-up
+// first, then a top-down pass drops what an ancestor already says.
+func (tr *tree[V]) aggregate(equal func(a, b V) bool) *tree[V] {
+	next := &tree[V]{cfg: tr.cfg}
+	for _, ipType := range [2]int{4, 6} {
+		b := newBuilder[V]()
+		var inherited V
+		prune(fold(tr.root(ipType), equal), b, false, inherited, equal)
+		next.set(ipType, b.root)
+	}
+	return next
+}
+
+// fold returns a private copy of the subtree n in which, bottom-up,
+// every pair of sibling halves holding equal values has been moved into
+// their parent. The parent's own value, if any, was shadowed by the two
+// halves and is overwritten. The copy is not compressed.
+func fold[V any](n *node[V], equal func(a, b V) bool) *node[V] {
+	if n == nil {
+		return nil
+	}
+	c := n.clone()
+	c.children[0], c.children[1] = fold(n.children[0], equal), fold(n.children[1], equal)
+
+	// Since the halves diverge right below c, c is their branch node.
+	lo, hi := c.children[0], c.children[1]
+	if lo != nil && hi != nil && lo.set && hi.set &&
+		lo.key.plen == c.key.plen+1 && hi.key.plen == c.key.plen+1 &&
+		equal(lo.value, hi.value) {
+		c.store(lo.value)
+		c.orig = nil
+		lo.unset()
+		hi.unset()
+	}
+	return c
+}
+
+// prune feeds b every valued node below n in canonical order, except
+// those whose value equals the one they would inherit.
+func prune[V any](n *node[V], b *builder[V], has bool, inherited V, equal func(a, b V) bool) {
+	if n == nil {
+		return
+	}
+	if n.set && !(has && equal(inherited, n.value)) {
+		b.add(n.key, n.value).orig = n.orig
+		has, inherited = true, n.value
+	}
+	prune(n.children[0], b, has, inherited, equal)
+	prune(n.children[1], b, has, inherited, equal)
+}
+
+// changes lists, in canonical order, the events that turn the subtree
+// old into next.
+func changes[V any](old, next *node[V], ipType int, equal func(a, b V) bool) []Event[V] {
+	var events []Event[V]
+	lockstep(old, next, func(x, y *node[V]) {
+		switch {
+		case y == nil:
+			events = append(events, Event[V]{Kind: Deleted, Prefix: x.cidr(ipType), Value: x.value})
+		case x == nil:
+			events = append(events, Event[V]{Kind: Added, Prefix: y.cidr(ipType), Value: y.value})
+		case !equal(x.value, y.value):
+			events = append(events, Event[V]{Kind: Replaced, Prefix: y.cidr(ipType), Value: y.value, Old: x.value})
+		}
+	})
+	return events
+}
@@ -0,0 +1,438 @@
+package pytricia
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/netip"
+	"slices"
+)
+
+// Binary format, version 1. All of it but the trailer is covered by the
+// checksum.
+//
+//	magic    "PYTR"
+//	version  1 byte
+//	IPv4     the family subtree, pre-order, 0 branch first
+//	IPv6     likewise
+//	trailer  CRC-32 (IEEE) of everything above, big-endian
+//
+// Each node is a flags byte, its prefix length, and the address bytes
+// covering that length; then, if flagged, the original key's address
+// (4 or 16 bytes) and the value as a uvarint length and the codec's
+// bytes; then its children.
+const (
+	binaryMagic   = "PYTR"
+	binaryVersion = 1
+	valueChunk    = 64 << 10 // most a value read allocates ahead of its bytes
+)
+
+const (
+	flagValue = 1 << iota // the node holds a value
+	flagLeft              // a 0-branch child follows
+	flagRight             // a 1-branch child follows
+	flagOrig              // the original key is kept (PreserveOriginalKey)
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (t *Trie[V]) MarshalBinary() ([]byte, error) { return t.load().MarshalBinary() }
+
+// WriteTo writes the trie in the binary format; it implements
+// io.WriterTo.
+func (t *Trie[V]) WriteTo(w io.Writer) (int64, error) { return t.load().WriteTo(w) }
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler: it replaces
+// the trie's contents with the encoded ones, as one write. Keys are
+// taken as if inserted, under the trie's key mode and embedded-IPv4
+// policies rather than the writer's.
+func (t *Trie[V]) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	next := newTree[V](t.load().cfg)
+	if _, err := next.readFrom(r); err != nil {
+		return err
+	}
+	if r.Len() > 0 {
+		return fmt.Errorf("%w: %d bytes of trailing data", ErrBadFormat, r.Len())
+	}
+	t.replace(next)
+	return nil
+}
+
+// ReadFrom replaces the trie's contents with a trie in the binary
+// format read from r, as one write; it implements io.ReaderFrom. Given
+// an io.ByteReader, it reads no further than the end of the encoding.
+func (t *Trie[V]) ReadFrom(r io.Reader) (int64, error) {
+	next := newTree[V](t.load().cfg)
+	n, err := next.readFrom(r)
+	if err != nil {
+		return n, err
+	}
+	t.replace(next)
+	return n, nil
+}
+
+// replace publishes next as the trie's entire content. Subscribers see
+// Cleared, then Added for every prefix in next.
+func (t *Trie[V]) replace(next *tree[V]) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.root.Store(next)
+	if len(t.subs) > 0 {
+		t.notify(Event[V]{Kind: Cleared})
+		for p, v := range next.All() {
+			t.notify(Event[V]{Kind: Added, Prefix: p, Value: v})
+		}
+	}
+}
+
+// MarshalBinary encodes the version; see Trie.MarshalBinary.
+func (tr *tree[V]) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := tr.WriteTo(&buf)
+	return buf.Bytes(), err
+}
+
+// WriteTo encodes the version; see Trie.WriteTo.
+func (tr *tree[V]) WriteTo(w io.Writer) (int64, error) {
+	codec, err := tr.codec()
+	if err != nil {
+		return 0, err
+	}
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	crc := crc32.NewIEEE()
+	e := &encoder[V]{w: io.MultiWriter(bw, crc), codec: codec}
+
+	e.write([]byte(binaryMagic))
+	e.write([]byte{binaryVersion})
+	for _, ipType := range [2]int{4, 6} {
+		if err := e.node(tr.root(ipType), ipType); err != nil {
+			return cw.n, err
+		}
+	}
+	bw.Write(crc.Sum(nil))
+	if e.err == nil {
+		e.err = bw.Flush()
+	}
+	return cw.n, e.err
+}
+
+// readFrom fills the empty version tr from r.
+func (tr *tree[V]) readFrom(r io.Reader) (int64, error) {
+	codec, err := tr.codec()
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := r.(io.ByteReader); !ok {
+		r = bufio.NewReader(r)
+	}
+	d := &decoder[V]{r: r, crc: crc32.NewIEEE(), codec: codec}
+
+	var head [len(binaryMagic) + 1]byte
+	if err := d.read(head[:]); err != nil {
+		return d.n, err
+	}
+	if string(head[:len(binaryMagic)]) != binaryMagic {
+		return d.n, fmt.Errorf("%w: not a serialized trie", ErrBadFormat)
+	}
+	if v := head[len(binaryMagic)]; v != binaryVersion {
+		return d.n, fmt.Errorf("%w: unsupported version %d", ErrBadFormat, v)
+	}
+	var roots [2]*node[V]
+	for i, ipType := range [2]int{4, 6} {
+		root, err := d.node(nil, 0, ipType)
+		if err != nil {
+			return d.n, err
+		}
+		roots[i] = root
+	}
+
+	sum := d.crc.Sum32()
+	var trailer [4]byte
+	if err := d.read(trailer[:]); err != nil {
+		return d.n, err
+	}
+	if binary.BigEndian.Uint32(trailer[:]) != sum {
+		return d.n, fmt.Errorf("%w: checksum mismatch", ErrBadFormat)
+	}
+	return d.n, tr.rekey(roots)
+}
+
+// rekey fills the empty version tr with the decoded IPv4 and IPv6
+// subtrees, putting every key through resolve and original as if it
+// were written anew: the writer's options need not be tr's. The nodes
+// stay as decoded unless a key moves, as an embedded IPv4 one unmapped
+// does; then both families are rebuilt in canonical order.
+func (tr *tree[V]) rekey(roots [2]*node[V]) error {
+	type entry struct {
+		ipType int
+		k      key
+		n      *node[V]
+	}
+	var (
+		entries []entry
+		moved   bool
+		err     error
+	)
+	for i, from := range [2]int{4, 6} {
+		walk(roots[i], func(n *node[V]) bool {
+			p := n.cidr(from)
+			var e entry
+			if e.ipType, e.k, err = tr.resolve(p); err != nil {
+				return false
+			}
+			e.n, n.orig = n, tr.original(p)
+			moved = moved || e.ipType != from || e.k != n.key
+			entries = append(entries, e)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !moved {
+		tr.v4, tr.v6 = roots[0], roots[1]
+		return nil
+	}
+
+	slices.SortStableFunc(entries, func(a, b entry) int {
+		switch {
+		case a.ipType != b.ipType:
+			return a.ipType - b.ipType
+		case keyLess(a.k, b.k):
+			return -1
+		case keyLess(b.k, a.k):
+			return 1
+		}
+		return 0
+	})
+	b4, b6 := newBuilder[V](), newBuilder[V]()
+	for i, e := range entries {
+		if i > 0 && e.ipType == entries[i-1].ipType && e.k == entries[i-1].k {
+			return fmt.Errorf("%w: %v given twice", ErrExists, e.k.prefix(e.ipType))
+		}
+		b := b4
+		if e.ipType == 6 {
+			b = b6
+		}
+		b.add(e.k, e.n.value).orig = e.n.orig
+	}
+	tr.v4, tr.v6 = b4.root, b6.root
+	return nil
+}
+
+// codec returns the configured value codec.
+func (tr *tree[V]) codec() (Codec[V], error) { return codecOf[V](tr.cfg) }
+
+// codecOf returns the value codec configured in o.
+func codecOf[V any](o *options) (Codec[V], error) {
+	switch c := o.codec.(type) {
+	case nil:
+		return DefaultCodec[V]{}, nil
+	case Codec[V]:
+		return c, nil
+	default:
+		var zero V
+		return nil, fmt.Errorf("codec %T cannot handle %T values", c, zero)
+	}
+}
+
+// encoder writes nodes, remembering the first error.
+type encoder[V any] struct {
+	w     io.Writer
+	codec Codec[V]
+	buf   []byte // scratch for one node
+	err   error
+}
+
+// write writes b unless an earlier write failed.
+func (e *encoder[V]) write(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+// node writes the subtree n.
+func (e *encoder[V]) node(n *node[V], ipType int) error {
+	var flags byte
+	if n.set {
+		flags |= flagValue
+	}
+	if n.children[0] != nil {
+		flags |= flagLeft
+	}
+	if n.children[1] != nil {
+		flags |= flagRight
+	}
+	if n.orig != nil {
+		flags |= flagOrig
+	}
+	e.buf = append(e.buf[:0], flags, n.key.plen)
+	e.buf = appendAddr(e.buf, n.key.prefix(ipType).Addr())[:2+(n.key.plen+7)/8]
+	if n.orig != nil {
+		e.buf = appendAddr(e.buf, n.orig.Addr())
+	}
+	var data []byte
+	if n.set {
+		var err error
+		if data, err = e.codec.Encode(n.value); err != nil {
+			return fmt.Errorf("encoding value of %v: %w", n.cidr(ipType), err)
+		}
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(data)))
+	}
+	e.write(e.buf)
+	e.write(data)
+	for _, c := range n.children {
+		if c != nil {
+			if err := e.node(c, ipType); err != nil {
+				return err
+			}
+		}
+	}
+	return e.err
+}
+
+// decoder reads nodes, feeding every byte read to the checksum.
+type decoder[V any] struct {
+	r       io.Reader
+	crc     hash.Hash32
+	codec   Codec[V]
+	n       int64
+	scratch [16]byte // for fixed-size fields
+	data    []byte   // for values, reused
+}
+
+// read fills b.
+func (d *decoder[V]) read(b []byte) error {
+	m, err := io.ReadFull(d.r, b)
+	d.n += int64(m)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("%w: %w", ErrBadFormat, err)
+	}
+	d.crc.Write(b)
+	return nil
+}
+
+// ReadByte implements io.ByteReader, for binary.ReadUvarint.
+func (d *decoder[V]) ReadByte() (byte, error) {
+	err := d.read(d.scratch[:1])
+	return d.scratch[0], err
+}
+
+// node reads the subtree below parent (nil for a family root) on the
+// given side, checking it is shaped as the trie would have built it.
+func (d *decoder[V]) node(parent *node[V], side int, ipType int) (*node[V], error) {
+	if err := d.read(d.scratch[:2]); err != nil {
+		return nil, err
+	}
+	flags, plen := d.scratch[0], int(d.scratch[1])
+	bitLen := 32
+	if ipType == 6 {
+		bitLen = 128
+	}
+	bad := func(why string) (*node[V], error) {
+		return nil, fmt.Errorf("%w: IPv%d node /%d: %s", ErrBadFormat, ipType, plen, why)
+	}
+	if flags&^(flagValue|flagLeft|flagRight|flagOrig) != 0 || plen > bitLen {
+		return bad("bad header")
+	}
+
+	d.scratch = [16]byte{}
+	if err := d.read(d.scratch[:(plen+7)/8]); err != nil {
+		return nil, err
+	}
+	p := netip.PrefixFrom(netip.AddrFrom16(d.scratch), plen)
+	if ipType == 4 {
+		p = netip.PrefixFrom(netip.AddrFrom4([4]byte(d.scratch[:4])), plen)
+	}
+	n := &node[V]{key: newKey(p)}
+	switch {
+	case p != p.Masked():
+		return bad("host bits set")
+	case parent == nil && plen != 0:
+		return bad("family root is not /0")
+	case parent != nil && (plen <= int(parent.key.plen) || !parent.key.contains(n.key) ||
+		n.key.bit(int(parent.key.plen)) != side):
+		return bad("misplaced below its parent")
+	case parent != nil && flags&flagValue == 0 && flags&(flagLeft|flagRight) != flagLeft|flagRight:
+		return bad("valueless node without two children")
+	case flags&flagOrig != 0 && flags&flagValue == 0:
+		return bad("original key without a value")
+	}
+
+	if flags&flagOrig != 0 {
+		if err := d.read(d.scratch[:bitLen/8]); err != nil {
+			return nil, err
+		}
+		a, _ := netip.AddrFromSlice(d.scratch[:bitLen/8])
+		o := netip.PrefixFrom(a, plen)
+		if o.Masked() != p {
+			return bad("original key does not match")
+		}
+		n.orig = &o
+	}
+	if flags&flagValue != 0 {
+		size, err := binary.ReadUvarint(d)
+		if err != nil {
+			return nil, err
+		}
+		// Grow as bytes arrive, so a corrupt length cannot allocate
+		// much more than the input actually holds.
+		d.data = d.data[:0]
+		for uint64(len(d.data)) < size {
+			start := len(d.data)
+			chunk := int(min(size-uint64(start), valueChunk))
+			d.data = slices.Grow(d.data, chunk)[:start+chunk]
+			if err := d.read(d.data[start:]); err != nil {
+				return nil, err
+			}
+		}
+		value, err := d.codec.Decode(d.data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: decoding value of %v: %w", ErrBadFormat, p, err)
+		}
+		n.store(value)
+	}
+
+	for b, flag := range [2]byte{flagLeft, flagRight} {
+		if flags&flag == 0 {
+			continue
+		}
+		c, err := d.node(n, b, ipType)
+		if err != nil {
+			return nil, err
+		}
+		n.children[b] = c
+	}
+	return n, nil
+}
+
+// appendAddr appends the 4 or 16 bytes of a.
+func appendAddr(b []byte, a netip.Addr) []byte {
+	if a.Is4() {
+		v := a.As4()
+		return append(b, v[:]...)
+	}
+	v := a.As16()
+	return append(b, v[:]...)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write implements io.Writer.
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,122 @@
+package pytricia
+
+import (
+	"fmt"
+	"iter"
+	"net/netip"
+)
+
+// BulkLoad builds a trie from items already in canonical order (see
+// Items); it is FromSortedIter over a slice.
+func BulkLoad[V any](items []Item[V], opts ...Option) (*Trie[V], error) {
+	return FromSortedIter(func(yield func(netip.Prefix, V) bool) {
+		for _, item := range items {
+			if !yield(item.Prefix, item.Value) {
+				return
+			}
+		}
+	}, opts...)
+}
+
+// FromSortedIter builds a trie in one pass from a sequence of prefixes
+// in canonical order: IPv4 before IPv6, then address ascending, shorter
+// prefix first (the order All yields). Nodes are linked bottom-up along
+// the rightmost path, so nothing is re-walked from the root, no string
+// is parsed and no lock is taken. Keys are checked as per the KeyMode
+// and host bits masked before ordering; a prefix seen twice or out of
+// order stops the load with an error.
+func FromSortedIter[V any](seq iter.Seq2[netip.Prefix, V], opts ...Option) (*Trie[V], error) {
+	tr := newTree[V](newOptions(opts))
+	b4, b6 := newBuilder[V](), newBuilder[V]()
+	var (
+		prev     netip.Prefix
+		prevKey  key
+		prevType int
+		err      error
+	)
+	for p, v := range seq {
+		var (
+			ipType int
+			k      key
+		)
+		if ipType, k, err = tr.resolve(p); err != nil {
+			break
+		}
+		if prev.IsValid() {
+			if ipType == prevType && k == prevKey {
+				err = fmt.Errorf("%w: %v given twice", ErrExists, p.Masked())
+				break
+			}
+			if ipType < prevType || (ipType == prevType && keyLess(k, prevKey)) {
+				err = fmt.Errorf("%w: %v after %v", ErrUnsorted, p.Masked(), prev.Masked())
+				break
+			}
+		}
+		prev, prevKey, prevType = p, k, ipType
+
+		b := b4
+		if ipType == 6 {
+			b = b6
+		}
+		b.add(k, v).orig = tr.original(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tr.v4, tr.v6 = b4.root, b6.root
+	t := &Trie[V]{}
+	t.root.Store(tr)
+	return t, nil
+}
+
+// builder assembles one family's subtree from keys arriving in canonical
+// order. Only the rightmost path is ever open, so it lives on a stack.
+type builder[V any] struct {
+	root  *node[V]
+	stack []*node[V] // path from root to the node added last
+}
+
+// newBuilder starts an empty subtree.
+func newBuilder[V any]() *builder[V] {
+	root := &node[V]{}
+	return &builder[V]{root: root, stack: []*node[V]{root}}
+}
+
+// add stores value at k, which must sort after every key added so far,
+// and returns the node holding it.
+func (b *builder[V]) add(k key, value V) *node[V] {
+	if k.plen == 0 {
+		b.root.store(value)
+		return b.root
+	}
+
+	// 1) Close every open node that does not contain k; the last one
+	//    closed is the child of top that k may share an edge with.
+	var last *node[V]
+	for !b.stack[len(b.stack)-1].key.contains(k) {
+		last = b.stack[len(b.stack)-1]
+		b.stack = b.stack[:len(b.stack)-1]
+	}
+	top := b.stack[len(b.stack)-1]
+
+	n := &node[V]{key: k}
+	n.store(value)
+
+	// 2) k leaves that edge part-way down: fork it with a branch node.
+	if last != nil {
+		if common := last.key.commonLen(k); common > int(top.key.plen) {
+			branch := &node[V]{key: k.truncate(common)}
+			branch.children[last.key.bit(common)] = last
+			branch.children[k.bit(common)] = n
+			top.children[k.bit(int(top.key.plen))] = branch
+			b.stack = append(b.stack, branch, n)
+			return n
+		}
+	}
+
+	// 3) Otherwise k hangs straight off top, on a still-empty side.
+	top.children[k.bit(int(top.key.plen))] = n
+	b.stack = append(b.stack, n)
+	return n
+}
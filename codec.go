@@ -0,0 +1,143 @@
+package pytricia
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Codec turns values into bytes and back for the binary format. Decode
+// must not keep data, which is reused once it returns.
+type Codec[V any] interface {
+	Encode(value V) ([]byte, error)
+	Decode(data []byte) (V, error)
+}
+
+// WithCodec sets the value codec of the binary format. Its type must
+// match the trie's value type.
+func WithCodec[V any](c Codec[V]) Option {
+	return func(o *options) { o.codec = c }
+}
+
+// DefaultCodec is the codec used unless WithCodec says otherwise. A
+// string, []byte, bool, int, int64, uint, uint64 or float64 – or nil,
+// in a trie of interface values such as PyTricia – is written directly
+// behind a one-byte tag; anything else goes through GobCodec.
+type DefaultCodec[V any] struct{}
+
+// Tags of DefaultCodec. They are part of the binary format: append only.
+const (
+	tagGob byte = iota
+	tagNil
+	tagString
+	tagBytes
+	tagBool
+	tagInt
+	tagInt64
+	tagUint
+	tagUint64
+	tagFloat64
+)
+
+// Encode implements Codec.
+func (DefaultCodec[V]) Encode(value V) ([]byte, error) {
+	switch v := any(value).(type) {
+	case nil:
+		return []byte{tagNil}, nil
+	case string:
+		return append([]byte{tagString}, v...), nil
+	case []byte:
+		return append([]byte{tagBytes}, v...), nil
+	case bool:
+		if v {
+			return []byte{tagBool, 1}, nil
+		}
+		return []byte{tagBool, 0}, nil
+	case int:
+		return binary.AppendVarint([]byte{tagInt}, int64(v)), nil
+	case int64:
+		return binary.AppendVarint([]byte{tagInt64}, v), nil
+	case uint:
+		return binary.AppendUvarint([]byte{tagUint}, uint64(v)), nil
+	case uint64:
+		return binary.AppendUvarint([]byte{tagUint64}, v), nil
+	case float64:
+		return binary.BigEndian.AppendUint64([]byte{tagFloat64}, math.Float64bits(v)), nil
+	}
+	data, err := GobCodec[V]{}.Encode(value)
+	return append([]byte{tagGob}, data...), err
+}
+
+// Decode implements Codec.
+func (DefaultCodec[V]) Decode(data []byte) (V, error) {
+	var zero V
+	if len(data) == 0 {
+		return zero, errors.New("empty value")
+	}
+	tag, body := data[0], data[1:]
+	var x any
+	switch tag {
+	case tagGob:
+		return GobCodec[V]{}.Decode(body)
+	case tagNil:
+		return zero, nil
+	case tagString:
+		x = string(body)
+	case tagBytes:
+		x = bytes.Clone(body)
+	case tagBool:
+		if len(body) != 1 || body[0] > 1 {
+			return zero, errors.New("bad bool")
+		}
+		x = body[0] == 1
+	case tagInt, tagInt64:
+		v, n := binary.Varint(body)
+		if n <= 0 || n != len(body) || tag == tagInt && int64(int(v)) != v {
+			return zero, errors.New("bad integer")
+		}
+		if x = v; tag == tagInt {
+			x = int(v)
+		}
+	case tagUint, tagUint64:
+		v, n := binary.Uvarint(body)
+		if n <= 0 || n != len(body) || tag == tagUint && uint64(uint(v)) != v {
+			return zero, errors.New("bad integer")
+		}
+		if x = v; tag == tagUint {
+			x = uint(v)
+		}
+	case tagFloat64:
+		if len(body) != 8 {
+			return zero, errors.New("bad float")
+		}
+		x = math.Float64frombits(binary.BigEndian.Uint64(body))
+	default:
+		return zero, fmt.Errorf("unknown value tag %d", tag)
+	}
+	v, ok := x.(V)
+	if !ok {
+		return zero, fmt.Errorf("%T value in a trie of %T", x, zero)
+	}
+	return v, nil
+}
+
+// GobCodec encodes values with encoding/gob, which must know their
+// types (see gob.Register).
+type GobCodec[V any] struct{}
+
+// Encode implements Codec.
+func (GobCodec[V]) Encode(value V) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&value)
+	return buf.Bytes(), err
+}
+
+// Decode implements Codec.
+func (GobCodec[V]) Decode(data []byte) (V, error) {
+	var value V
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+	return value, err
+}
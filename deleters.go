@@ -1,54 +1,87 @@
 package pytricia
 
-import "errors"
+import (
+	"fmt"
+	"net/netip"
+)
 
-// Delete removes a prefix (or single IP) and prunes now-empty branches.
-func (t *PyTricia) Delete(cidr string) error {
-	// 1)  Locate the node quickly under read-lock.
-	t.mutex.RLock()
-	target := t.keyNode(cidr)
-	t.mutex.RUnlock()
-	if target == nil {
-		return errors.New("CIDR not found")
+// Delete removes a prefix (or single IP) and re-compresses the path.
+func (t *Trie[V]) Delete(cidr string) error {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		return err
 	}
+	return t.DeletePrefix(p)
+}
+
+// DeletePrefix: Delete for a netip.Prefix
+func (t *Trie[V]) DeletePrefix(p netip.Prefix) error {
+	return t.commit(func(tr *tree[V]) (*tree[V], Event[V], error) { return tr.del(p) })
+}
 
-	// 2)  Promote to write-lock once for the actual mutation.
+// Clear wipes the entire trie in O(1) time by publishing an empty version.
+func (t *Trie[V]) Clear() {
 	t.mutex.Lock()
-	// Re-validate in case another writer deleted it meanwhile.
-	if target.value == nil && target.children[0] == nil && target.children[1] == nil {
-		// Either someone already removed it or it never held a value.
-		t.mutex.Unlock()
-		return errors.New("CIDR not found")
-	}
-
-	// Clear the stored value.
-	target.value = nil
-
-	// Prune ancestor chain while the branch is empty.
-	for n := target; n.parent != nil &&
-		n.value == nil &&
-		n.children[0] == nil &&
-		n.children[1] == nil; {
-
-		p := n.parent
-		if p.children[0] == n {
-			p.children[0] = nil
-		} else if p.children[1] == n {
-			p.children[1] = nil
+	t.root.Store(newTree[V](t.load().cfg))
+	t.notify(Event[V]{Kind: Cleared})
+	t.mutex.Unlock()
+}
+
+// del returns a new version without p. tr itself is never modified.
+func (tr *tree[V]) del(p netip.Prefix) (*tree[V], Event[V], error) {
+	var ev Event[V]
+	ipType, k, err := tr.resolve(p)
+	if err != nil {
+		return nil, ev, err
+	}
+	root, old, ok := remove(tr.root(ipType), k, true)
+	if !ok {
+		return nil, ev, fmt.Errorf("%w: %v", ErrNotFound, k.prefix(ipType))
+	}
+	ev = Event[V]{Kind: Deleted, Prefix: old.cidr(ipType), Value: old.value}
+	return tr.with(ipType, root), ev, nil
+}
+
+// remove returns a copy of the subtree n with the value at exactly k
+// dropped (and the node that held it), splicing out any node left without a value
+// and with fewer than two children; ok is false (and n returned as-is)
+// when k holds no value. The family root (isRoot) always survives. Only
+// nodes on the path to k are copied.
+func remove[V any](n *node[V], k key, isRoot bool) (repl, old *node[V], ok bool) {
+	if n.key.plen == k.plen {
+		if !n.set {
+			return n, nil, false
 		}
-		n = p
+		if !isRoot && (n.children[0] == nil || n.children[1] == nil) {
+			return onlyChild(n), n, true
+		}
+		c := n.clone()
+		c.unset()
+		return c, n, true
 	}
-	t.mutex.Unlock()
-	return nil
+
+	c := n.child(k)
+	if c == nil || !c.key.contains(k) {
+		return n, nil, false
+	}
+	sub, old, ok := remove(c, k, false)
+	if !ok {
+		return n, nil, false
+	}
+
+	cp := n.clone()
+	cp.children[k.bit(int(n.key.plen))] = sub
+	// The copy may now be a valueless pass-through node.
+	if !isRoot && !cp.set && (cp.children[0] == nil || cp.children[1] == nil) {
+		return onlyChild(cp), old, true
+	}
+	return cp, old, true
 }
 
-// Clear wipes the entire trie in O(1) time while holding the write-lock.
-func (t *PyTricia) Clear() {
-	t.mutex.Lock()
-	// Keep the same mutex instance (can’t replace it while locked).
-	t.children[0], t.children[1] = nil, nil
-	t.value = nil
-	t.parent = nil // root has no parent; safe to set
-	t.ipType = 0   // if you track type info
-	t.mutex.Unlock()
+// onlyChild returns whichever child of n is set (or nil).
+func onlyChild[V any](n *node[V]) *node[V] {
+	if n.children[0] != nil {
+		return n.children[0]
+	}
+	return n.children[1]
 }
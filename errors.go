@@ -0,0 +1,73 @@
+package pytricia
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors, for use with errors.Is. Errors returned by the trie
+// wrap one of these, usually adding the prefix involved.
+var (
+	// ErrNotFound: Set or Delete named a prefix that holds no value.
+	ErrNotFound = errors.New("CIDR not found")
+	// ErrExists: Add named a prefix that already holds a value.
+	ErrExists = errors.New("CIDR already present")
+	// ErrInvalidPrefix: a key could not be used; the error is a
+	// *PrefixError carrying the details.
+	ErrInvalidPrefix = errors.New("invalid IP/CIDR")
+	// ErrUnsorted: bulk input was not in canonical order.
+	ErrUnsorted = errors.New("prefixes not in canonical order")
+	// ErrTxnDone: a Txn was used after Commit or Rollback.
+	ErrTxnDone = errors.New("transaction already finished")
+	// ErrNoSpace: AllocateFree found no free prefix of the length asked.
+	ErrNoSpace = errors.New("no free prefix")
+	// ErrInvalidRange: a range ends before it starts, or mixes families.
+	ErrInvalidRange = errors.New("invalid IP range")
+	// ErrBadFormat: serialized input is corrupt, truncated or of an
+	// unknown version.
+	ErrBadFormat = errors.New("malformed serialized trie")
+)
+
+// Reason classifies why a PrefixError rejected its input.
+type Reason int
+
+const (
+	ReasonBadAddress   Reason = iota + 1 // the address part does not parse
+	ReasonBadMask                        // the mask is missing, malformed or too long
+	ReasonHostBits                       // bits are set past the mask
+	ReasonEmbeddedIPv4                   // an embedded IPv4 address the policy refuses
+)
+
+// String returns a short description of the reason.
+func (r Reason) String() string {
+	switch r {
+	case ReasonBadAddress:
+		return "bad address"
+	case ReasonBadMask:
+		return "bad mask"
+	case ReasonHostBits:
+		return "host bits set"
+	case ReasonEmbeddedIPv4:
+		return "embedded IPv4"
+	}
+	return "unknown reason"
+}
+
+// PrefixError reports a key that was rejected, and why. It wraps
+// ErrInvalidPrefix, so errors.Is(err, ErrInvalidPrefix) holds for it.
+type PrefixError struct {
+	Input  string // the key as given
+	Pos    int    // byte offset in Input where the problem starts, or -1
+	Reason Reason
+}
+
+// Error implements error.
+func (e *PrefixError) Error() string {
+	if e.Pos < 0 {
+		return fmt.Sprintf("invalid IP/CIDR %q: %v", e.Input, e.Reason)
+	}
+	return fmt.Sprintf("invalid IP/CIDR %q at offset %d: %v", e.Input, e.Pos, e.Reason)
+}
+
+// Unwrap returns ErrInvalidPrefix.
+func (e *PrefixError) Unwrap() error { return ErrInvalidPrefix }
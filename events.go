@@ -0,0 +1,112 @@
+package pytricia
+
+import "net/netip"
+
+// EventKind tells what a change Event describes.
+type EventKind int
+
+const (
+	Added    EventKind = iota + 1 // a prefix that was absent got a value
+	Replaced                      // a present prefix got a new value
+	Deleted                       // a present prefix was removed
+	Cleared                       // the whole trie was wiped
+)
+
+// String returns the kind's name.
+func (k EventKind) String() string {
+	switch k {
+	case Added:
+		return "Added"
+	case Replaced:
+		return "Replaced"
+	case Deleted:
+		return "Deleted"
+	case Cleared:
+		return "Cleared"
+	}
+	return "EventKind(?)"
+}
+
+// Event describes one change to a Trie.
+type Event[V any] struct {
+	Kind   EventKind
+	Prefix netip.Prefix // the changed prefix; zero for Cleared
+	Value  V            // new value (Added, Replaced) or removed value (Deleted)
+	Old    V            // previous value, for Replaced only
+
+	// Dropped counts the events this subscriber lost to a full buffer
+	// just before this one. Non-zero means the subscriber's mirror has
+	// diverged and should be rebuilt, e.g. from a Snapshot.
+	Dropped uint64
+}
+
+// subscriberBuffer is the channel capacity each subscriber gets.
+const subscriberBuffer = 256
+
+// subscriber is one Subscribe registration.
+type subscriber[V any] struct {
+	filter  netip.Prefix // masked; invalid means everything
+	ch      chan Event[V]
+	dropped uint64
+}
+
+// Subscribe registers for change events on prefixes inside filter (the
+// zero netip.Prefix subscribes to the whole trie); Cleared is delivered
+// to every subscriber. Events arrive in commit order, one per changed
+// prefix, and a Txn's events arrive together once it commits.
+//
+// Each subscriber has a buffer of 256 events. Writers never block on a
+// slow reader: when the buffer is full the event is dropped and counted,
+// and the count is reported in Dropped on the next event delivered.
+//
+// cancel unregisters the subscription and closes the channel; calling it
+// more than once is harmless. The filter is a key like any other, so an
+// embedded IPv4 filter the trie unmaps watches the IPv4 prefixes it
+// stands for, and a filter the trie's key mode or embedded-IPv4
+// policies refuse gets a channel already closed.
+func (t *Trie[V]) Subscribe(filter netip.Prefix) (<-chan Event[V], func()) {
+	s := &subscriber[V]{ch: make(chan Event[V], subscriberBuffer)}
+	if filter.IsValid() {
+		ipType, k, err := t.load().resolve(filter)
+		if err != nil {
+			close(s.ch)
+			return s.ch, func() {}
+		}
+		s.filter = k.prefix(ipType)
+	}
+
+	t.mutex.Lock()
+	if t.subs == nil {
+		t.subs = make(map[*subscriber[V]]struct{})
+	}
+	t.subs[s] = struct{}{}
+	t.mutex.Unlock()
+
+	cancel := func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if _, ok := t.subs[s]; ok {
+			delete(t.subs, s)
+			close(s.ch)
+		}
+	}
+	return s.ch, cancel
+}
+
+// notify fans an event out to every interested subscriber without ever
+// blocking. Caller must hold the writer mutex.
+func (t *Trie[V]) notify(ev Event[V]) {
+	for s := range t.subs {
+		if ev.Kind != Cleared && s.filter.IsValid() &&
+			(s.filter.Bits() > ev.Prefix.Bits() || !s.filter.Contains(ev.Prefix.Addr())) {
+			continue
+		}
+		ev.Dropped = s.dropped
+		select {
+		case s.ch <- ev:
+			s.dropped = 0
+		default:
+			s.dropped++
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package pytricia
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Gaps returns, in canonical order, every maximal prefix inside within
+// that has no stored prefix in it: the free space of within. A value
+// stored at within itself, or above it, does not count as occupying it.
+func (t *Trie[V]) Gaps(within netip.Prefix) []netip.Prefix { return t.load().Gaps(within) }
+
+// AllocateFree returns the lowest free prefix of the given length inside
+// within (see Gaps), without storing anything there. It fails with
+// ErrNoSpace when there is none. The length counts in the family within
+// is stored as, so IPv4 for an embedded prefix the trie unmaps.
+func (t *Trie[V]) AllocateFree(within netip.Prefix, length int) (netip.Prefix, error) {
+	return t.load().AllocateFree(within, length)
+}
+
+// Gaps returns the free space of within; see Trie.Gaps.
+func (tr *tree[V]) Gaps(within netip.Prefix) []netip.Prefix {
+	out := []netip.Prefix{}
+	ipType, k, err := tr.resolve(within)
+	if err != nil {
+		return out
+	}
+	tr.free(ipType, k, func(gap key) bool {
+		out = append(out, gap.prefix(ipType))
+		return true
+	})
+	return out
+}
+
+// AllocateFree finds a free prefix; see Trie.AllocateFree.
+func (tr *tree[V]) AllocateFree(within netip.Prefix, length int) (netip.Prefix, error) {
+	ipType, k, err := tr.resolve(within)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	bitLen := 32
+	if ipType == 6 {
+		bitLen = 128
+	}
+	if length < int(k.plen) || length > bitLen {
+		return netip.Prefix{}, &PrefixError{Input: fmt.Sprintf("/%d", length), Pos: 1, Reason: ReasonBadMask}
+	}
+
+	// Gaps come lowest address first, so the first one that is large
+	// enough starts with the answer.
+	var found key
+	ok := false
+	tr.free(ipType, k, func(gap key) bool {
+		if int(gap.plen) <= length {
+			found, ok = gap, true
+		}
+		return !ok
+	})
+	if !ok {
+		return netip.Prefix{}, fmt.Errorf("%w: no /%d free in %v", ErrNoSpace, length, k.prefix(ipType))
+	}
+	return found.truncate(length).prefix(ipType), nil
+}
+
+// free runs the package-level free over the subtree inside k, treating
+// a value stored at k itself as absent.
+func (tr *tree[V]) free(ipType int, k key, emit func(key) bool) {
+	s := subtree(tr.root(ipType), k)
+	if s != nil && s.key == k && s.set {
+		s = s.clone()
+		s.unset()
+	}
+	free(k, s, emit)
+}
@@ -1,76 +1,187 @@
 package pytricia
 
+import "net/netip"
+
+// Get: longest-prefix match – returns the stored value and whether
+// anything matched at all
+func (t *Trie[V]) Get(cidr string) (V, bool) { return t.load().Get(cidr) }
+
+// GetKey: returns the CIDR string that actually stored the value
+func (t *Trie[V]) GetKey(cidr string) string { return t.load().GetKey(cidr) }
+
+// GetKV: key + value in one call (avoids 2× parseCIDR)
+func (t *Trie[V]) GetKV(cidr string) (string, V, bool) { return t.load().GetKV(cidr) }
+
+// Contains: does a prefix (or IP) resolve to *anything*?
+func (t *Trie[V]) Contains(cidr string) bool { return t.load().Contains(cidr) }
+
+// HasKey: exact-match test (node must *store* a value at that prefix)
+func (t *Trie[V]) HasKey(cidr string) bool { return t.load().HasKey(cidr) }
+
+// GetPrefix: Get for a netip.Prefix
+func (t *Trie[V]) GetPrefix(p netip.Prefix) (V, bool) { return t.load().GetPrefix(p) }
+
+// LookupPrefix: longest-prefix match for a netip.Prefix, returning the
+// stored key and value; ok is false when nothing covers p.
+func (t *Trie[V]) LookupPrefix(p netip.Prefix) (key netip.Prefix, value V, ok bool) {
+	return t.load().LookupPrefix(p)
+}
+
+// LookupAddr: longest-prefix match for a single address
+func (t *Trie[V]) LookupAddr(a netip.Addr) (key netip.Prefix, value V, ok bool) {
+	return t.load().LookupAddr(a)
+}
+
+// ContainsAddr: does an address resolve to *anything*?
+func (t *Trie[V]) ContainsAddr(a netip.Addr) bool { return t.load().ContainsAddr(a) }
+
+// HasPrefix: exact-match test for a netip.Prefix
+func (t *Trie[V]) HasPrefix(p netip.Prefix) bool { return t.load().HasPrefix(p) }
+
 // Get: longest-prefix match – returns the stored value (or nil)
 func (t *PyTricia) Get(cidr string) interface{} {
-	if n := t.getNode(cidr); n != nil {
-		return n.value
+	value, _ := t.Trie.Get(cidr)
+	return value
+}
+
+// GetKV: key + value in one call (avoids 2× parseCIDR)
+func (t *PyTricia) GetKV(cidr string) (string, interface{}) {
+	key, value, _ := t.Trie.GetKV(cidr)
+	return key, value
+}
+
+// GetPrefix: Get for a netip.Prefix
+func (t *PyTricia) GetPrefix(p netip.Prefix) interface{} {
+	value, _ := t.Trie.GetPrefix(p)
+	return value
+}
+
+// Get: longest-prefix match – returns the stored value and whether
+// anything matched at all
+func (tr *tree[V]) Get(cidr string) (V, bool) {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		var zero V
+		return zero, false
 	}
-	return nil
+	return tr.GetPrefix(p)
 }
 
 // GetKey: returns the CIDR string that actually stored the value
-func (t *PyTricia) GetKey(cidr string) string {
-	if n := t.getNode(cidr); n != nil {
-		if c := n.cidr(); c != nil {
-			return c.String()
-		}
+func (tr *tree[V]) GetKey(cidr string) string {
+	if key, _, ok := tr.lookupString(cidr); ok {
+		return key.String()
 	}
 	return ""
 }
 
 // GetKV: key + value in one call (avoids 2× parseCIDR)
-func (t *PyTricia) GetKV(cidr string) (string, interface{}) {
-	if n := t.getNode(cidr); n != nil {
-		if c := n.cidr(); c != nil {
-			return c.String(), n.value
-		}
+func (tr *tree[V]) GetKV(cidr string) (string, V, bool) {
+	if key, value, ok := tr.lookupString(cidr); ok {
+		return key.String(), value, true
 	}
-	return "", nil
+	var zero V
+	return "", zero, false
 }
 
 // Contains: does a prefix (or IP) resolve to *anything*?
-func (t *PyTricia) Contains(cidr string) bool { return t.Get(cidr) != nil }
+func (tr *tree[V]) Contains(cidr string) bool {
+	_, ok := tr.Get(cidr)
+	return ok
+}
 
 // HasKey: exact-match test (node must *store* a value at that prefix)
-func (t *PyTricia) HasKey(cidr string) bool { return t.keyNode(cidr) != nil }
+func (tr *tree[V]) HasKey(cidr string) bool {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	return tr.HasPrefix(p)
+}
+
+// GetPrefix: Get for a netip.Prefix
+func (tr *tree[V]) GetPrefix(p netip.Prefix) (V, bool) {
+	_, value, ok := tr.LookupPrefix(p)
+	return value, ok
+}
 
-// keyNode: exact-match node (no LPM) – read-lock held only for traversal
-func (t *PyTricia) keyNode(cidr string) *PyTricia {
-	ip, ones, err := parseCIDR(cidr)
+// LookupPrefix: longest-prefix match for a netip.Prefix, returning the
+// stored key and value; ok is false when nothing covers p.
+func (tr *tree[V]) LookupPrefix(p netip.Prefix) (key netip.Prefix, value V, ok bool) {
+	ipType, k, err := tr.resolve(p)
 	if err != nil {
-		return nil
+		return netip.Prefix{}, value, false
 	}
+	if n := longest(tr.root(ipType), k); n != nil {
+		return n.cidr(ipType), n.value, true
+	}
+	return netip.Prefix{}, value, false
+}
 
-	t.mutex.RLock()
-	defer t.mutex.RUnlock()
+// LookupAddr: longest-prefix match for a single address
+func (tr *tree[V]) LookupAddr(a netip.Addr) (key netip.Prefix, value V, ok bool) {
+	return tr.LookupPrefix(netip.PrefixFrom(a, a.BitLen()))
+}
 
-	n := t
-	for i := 0; i < ones; i++ {
-		n = n.children[bit(ip, i)]
-		if n == nil {
-			return nil
-		}
+// ContainsAddr: does an address resolve to *anything*?
+func (tr *tree[V]) ContainsAddr(a netip.Addr) bool {
+	_, _, ok := tr.LookupAddr(a)
+	return ok
+}
+
+// HasPrefix: exact-match test for a netip.Prefix
+func (tr *tree[V]) HasPrefix(p netip.Prefix) bool {
+	ipType, k, err := tr.resolve(p)
+	if err != nil {
+		return false
 	}
-	return n
+	n := find(tr.root(ipType), k)
+	return n != nil && n.set
 }
 
-// getNode: longest-prefix match (LPM)
-func (t *PyTricia) getNode(cidr string) *PyTricia {
-	ip, ones, err := parseCIDR(cidr)
+// lookupString: parseCIDR + LookupPrefix for the string API
+func (tr *tree[V]) lookupString(cidr string) (netip.Prefix, V, bool) {
+	p, err := parseCIDR(cidr)
 	if err != nil {
-		return nil
+		var zero V
+		return netip.Prefix{}, zero, false
 	}
+	return tr.LookupPrefix(p)
+}
 
-	t.mutex.RLock()
-	defer t.mutex.RUnlock()
+// find returns the node whose prefix is exactly k, valued or not.
+func find[V any](root *node[V], k key) *node[V] {
+	for n := root; n != nil; n = n.child(k) {
+		if !n.key.contains(k) {
+			return nil
+		}
+		if n.key.plen == k.plen {
+			return n
+		}
+	}
+	return nil
+}
 
-	n, best := t, (*PyTricia)(nil)
-	for i := 0; i < ones; i++ {
-		n = n.children[bit(ip, i)]
-		if n == nil {
-			break
+// subtree returns the topmost node whose prefix lies inside k.
+func subtree[V any](root *node[V], k key) *node[V] {
+	n := root
+	for n != nil && n.key.plen < k.plen {
+		if !n.key.contains(k) {
+			return nil
 		}
-		if n.value != nil {
+		n = n.child(k)
+	}
+	if n != nil && k.contains(n.key) {
+		return n
+	}
+	return nil
+}
+
+// longest returns the most specific valued node containing k.
+func longest[V any](root *node[V], k key) *node[V] {
+	var best *node[V]
+	for n := root; n != nil && n.key.contains(k); n = n.child(k) {
+		if n.set {
 			best = n
 		}
 	}
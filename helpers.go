@@ -1,186 +1,122 @@
 package pytricia
 
 import (
-	"errors"
 	"fmt"
 	"math/rand"
-	"net"
-	"strconv"
+	"net/netip"
 	"strings"
 	"time"
 )
 
-// ipToBinary converts an IP address to a binary representation.
-func ipToBinary(ip net.IP) []int {
-	// Determine the length based on IP type (IPv4 or IPv6)
-	var totalBits int
-	if ipv4 := ip.To4(); ipv4 != nil {
-		ip = ipv4
-		totalBits = 32 // IPv4
-	} else {
-		totalBits = 128 // IPv6
-	}
-	bits := make([]int, totalBits)
-
-	// Process each byte of the IP address
-	for i, b := range ip {
-		baseIndex := i * 8
-		bits[baseIndex] = int((b >> 7) & 1)
-		bits[baseIndex+1] = int((b >> 6) & 1)
-		bits[baseIndex+2] = int((b >> 5) & 1)
-		bits[baseIndex+3] = int((b >> 4) & 1)
-		bits[baseIndex+4] = int((b >> 3) & 1)
-		bits[baseIndex+5] = int((b >> 2) & 1)
-		bits[baseIndex+6] = int((b >> 1) & 1)
-		bits[baseIndex+7] = int(b & 1)
-	}
-	return bits
-}
-
-// binaryToCIDR converts a binary path to CIDR notation for both IPv4 and IPv6.
-func binaryToCIDR(path []byte, ipType int) *net.IPNet {
-	if ipType != 4 && ipType != 6 {
-		return nil
-	}
-
-	totalBits, increment := 32, 8
-	if ipType == 6 {
-		totalBits, increment = 128, 16
+// parseCIDR parses either a bare IP string ("8.8.8.8") or a CIDR
+// ("8.8.8.0/24") into a netip.Prefix. A lone address becomes a host
+// prefix (/32 for IPv4, /128 for IPv6); host bits are left for newKey
+// to mask. It is meant for untrusted input and never panics:
+//   - surrounding whitespace, and whitespace around the "/", is ignored
+//   - an IPv6 address may be bracketed ("[2001:db8::]/32") and may carry
+//     a zone ("fe80::1%eth0"), which is dropped
+//   - with a mask, an IPv4 address may leave out trailing zero octets
+//     ("10/8", "172.16/12")
+//
+// err is a *PrefixError pointing at the offending byte of cidr.
+func parseCIDR(cidr string) (netip.Prefix, error) {
+	fail := func(pos int, reason Reason) (netip.Prefix, error) {
+		return netip.Prefix{}, &PrefixError{Input: cidr, Pos: pos, Reason: reason}
 	}
 
-	// Preallocate slice to required size
-	pathLen := len(path)
-	if len(path) < totalBits {
-		extendedPath := make([]byte, totalBits)
-		copy(extendedPath, path)
-		path = extendedPath
+	start, end := trimSpace(cidr, 0, len(cidr))
+	addrEnd, maskStart := end, -1
+	if i := strings.LastIndexByte(cidr[start:end], '/'); i >= 0 {
+		addrEnd, maskStart = start+i, start+i+1
 	}
 
-	// Convert binary to IP address string
-	var ipStrBuilder strings.Builder
-	for i := 0; i < totalBits; i += increment {
-		if ipType == 4 && i > 0 {
-			ipStrBuilder.WriteByte('.')
-		}
-		if ipType == 6 && i > 0 {
-			ipStrBuilder.WriteByte(':')
-		}
-
-		if ipType == 4 {
-			// IPv4: Process each byte
-			byteVal := binarySliceToByte(path[i:min(i+8, totalBits)])
-			ipStrBuilder.WriteString(strconv.Itoa(int(byteVal)))
-		} else {
-			// IPv6: Process each hextet
-			hextet := binarySliceToUint16(path[i:min(i+16, totalBits)])
-			ipStrBuilder.WriteString(fmt.Sprintf("%04x", hextet))
+	// Address
+	as, ae := trimSpace(cidr, start, addrEnd)
+	bracketed := as < ae && cidr[as] == '['
+	if bracketed {
+		if ae-as < 2 || cidr[ae-1] != ']' {
+			return fail(ae, ReasonBadAddress)
 		}
+		as, ae = as+1, ae-1
 	}
-
-	// Parse the IP and mask
-	ip, ipNet, err := net.ParseCIDR(
-		ipStrBuilder.String() + "/" + strconv.Itoa(pathLen))
+	if as == ae {
+		return fail(as, ReasonBadAddress)
+	}
+	text := cidr[as:ae]
+	if dots := strings.Count(text, "."); maskStart >= 0 && !bracketed && dots < 3 &&
+		strings.IndexByte(text, ':') < 0 {
+		text += strings.Repeat(".0", 3-dots)
+	}
+	addr, err := netip.ParseAddr(text)
 	if err != nil {
-		fmt.Println("Error parsing CIDR:", err)
-		return nil
+		return fail(as+badAddrByte(cidr[as:ae]), ReasonBadAddress)
 	}
-	ipNet.IP = ip // Ensure that the IPNet struct has the correct IP
-
-	return ipNet
-}
-
-// binarySliceToByte converts a slice of binary to a byte
-func binarySliceToByte(bits []byte) byte {
-	var num byte
-	for _, bit := range bits {
-		num = (num << 1) + byte(bit)
+	if bracketed && addr.Is4() {
+		return fail(as-1, ReasonBadAddress)
 	}
-	return num
-}
-
-// binarySliceToUint16 converts a slice of binary to a uint16 for IPv6
-func binarySliceToUint16(bits []byte) uint16 {
-	var num uint16
-	for _, bit := range bits {
-		num = (num << 1) + uint16(bit)
+	addr = addr.WithZone("")
+	if maskStart < 0 {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
 	}
-	return num
-}
 
-// min is a helper function for min
-func min(a, b int) int {
-	if a < b {
-		return a
+	// Mask: digits only – no sign, nothing Atoi would let through.
+	ms, me := trimSpace(cidr, maskStart, end)
+	if ms == me || me-ms > 3 {
+		return fail(ms, ReasonBadMask)
 	}
-	return b
-}
-
-// typeIP returns type of IP address / CIDR
-// returns -1 if not a valid ip
-func typeIP(cidr string) int {
-	for i := 0; i < 6; i++ {
-		if cidr[i] == byte('.') {
-			return 4
-		} else if cidr[i] == byte(':') {
-			return 6
+	bits := 0
+	for i := ms; i < me; i++ {
+		if cidr[i] < '0' || cidr[i] > '9' {
+			return fail(i, ReasonBadMask)
 		}
+		bits = bits*10 + int(cidr[i]-'0')
+	}
+	if bits > addr.BitLen() {
+		return fail(ms, ReasonBadMask)
 	}
-	return -1
+	return netip.PrefixFrom(addr, bits), nil
 }
 
-// parseCIDR parses either a bare IP string ("8.8.8.8") or a CIDR
-// ("8.8.8.0/24") and returns:
-//
-//   - ip   – the address as a byte slice (IPv4 always 4 bytes, IPv6 16 bytes)
-//   - ones – the prefix length in bits (32 for a lone IPv4 address, 128 for IPv6)
-//   - err  – non-nil only if the input isn’t a valid IP/CIDR
-func parseCIDR(cidr string) (net.IP, int, error) {
-	var (
-		ip    net.IP
-		ipnet *net.IPNet
-		ones  int
-	)
-
-	// Case 1: the string is a bare IP address.
-	if ip = net.ParseIP(cidr); ip != nil {
-		switch typeIP(cidr) {
-		case 4:
-			ip = ip.To4() // <-- ensure 4-byte representation
-			ones = 32
-		case 6:
-			ones = 128
-		default:
-			return nil, 0, errors.New("invalid IP/CIDR")
-		}
-		return ip, ones, nil
+// trimSpace narrows s[lo:hi] to exclude leading and trailing ASCII
+// whitespace, returning the new bounds.
+func trimSpace(s string, lo, hi int) (int, int) {
+	for lo < hi && isSpace(s[lo]) {
+		lo++
 	}
-
-	// Case 2: must be CIDR notation (ip/mask).
-	var err error
-	ip, ipnet, err = net.ParseCIDR(cidr)
-	if err != nil {
-		return nil, 0, errors.New("invalid IP/CIDR")
+	for hi > lo && isSpace(s[hi-1]) {
+		hi--
 	}
+	return lo, hi
+}
 
-	ones, _ = ipnet.Mask.Size()
+// isSpace reports whether c is ASCII whitespace.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
 
-	// If the CIDR is IPv4 (mask ≤ 32) make sure we return a 4-byte IP.
-	if ip4 := ip.To4(); ip4 != nil && ones <= 32 {
-		ip = ip4
+// badAddrByte guesses where an address that failed to parse goes wrong:
+// the first byte no address can contain, else its start. A zone may hold
+// anything, so scanning stops at '%'.
+func badAddrByte(s string) int {
+	for i := 0; i < len(s) && s[i] != '%'; i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F' || c == '.' || c == ':') {
+			return i
+		}
 	}
-
-	return ip, ones, nil
+	return 0
 }
 
-// isCIDR returns whether an string is a CIDR
-// or simply an IP address
-func isCIDR(cidr string) bool {
-	for i := len(cidr); i > len(cidr)-4; i-- {
-		if cidr[i] == byte('/') {
-			return true
-		}
+// checkPrefix rejects a netip.Prefix the trie cannot store.
+func checkPrefix(p netip.Prefix) error {
+	if p.IsValid() {
+		return nil
 	}
-	return false
+	reason := ReasonBadAddress
+	if p.Addr().IsValid() {
+		reason = ReasonBadMask
+	}
+	return &PrefixError{Input: p.String(), Pos: -1, Reason: reason}
 }
 
 // randomIPv4 returns random ipv4 address
@@ -222,7 +158,10 @@ func randomIPv6CIDR() string {
 	return fmt.Sprintf("%s/%d", ip, mask)
 }
 
-// bit returns the i-th bit (0-based) of the IP address.
-func bit(ip []byte, i int) int {
-	return int((ip[i/8] >> (7 - uint(i%8))) & 1)
+// ipFamily returns the address family (4 or 6) of an address.
+func ipFamily(a netip.Addr) int {
+	if a.Is4() {
+		return 4
+	}
+	return 6
 }
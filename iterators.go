@@ -0,0 +1,104 @@
+package pytricia
+
+import (
+	"iter"
+	"net/netip"
+)
+
+// Every iterator below yields prefixes in canonical order: IPv4 before
+// IPv6, then by address ascending, a shorter prefix before a longer one
+// at the same address. That is simply a pre-order walk taking the 0
+// branch first, so no sorting is involved and memory stays flat.
+//
+// Consistency: a loop walks the version that was current when it
+// started and takes no lock, so it never blocks writers and never sees
+// a half-applied change. Writes made meanwhile – including from the
+// loop body itself – are not visible to that loop.
+
+// All iterates over every stored prefix and its value.
+func (t *Trie[V]) All() iter.Seq2[netip.Prefix, V] { return t.load().All() }
+
+// Prefixes iterates over every stored prefix.
+func (t *Trie[V]) Prefixes() iter.Seq[netip.Prefix] { return t.load().Prefixes() }
+
+// Descendants iterates over every stored prefix inside p, p included.
+// Unlike Children, p need not be covered by anything stored.
+func (t *Trie[V]) Descendants(p netip.Prefix) iter.Seq2[netip.Prefix, V] {
+	return t.load().Descendants(p)
+}
+
+// Ancestors iterates over every stored prefix containing p, p included,
+// least specific first.
+func (t *Trie[V]) Ancestors(p netip.Prefix) iter.Seq2[netip.Prefix, V] {
+	return t.load().Ancestors(p)
+}
+
+// All iterates over every stored prefix and its value.
+func (tr *tree[V]) All() iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		for _, ipType := range [2]int{4, 6} {
+			if !walk(tr.root(ipType), func(n *node[V]) bool {
+				return yield(n.cidr(ipType), n.value)
+			}) {
+				return
+			}
+		}
+	}
+}
+
+// Prefixes iterates over every stored prefix.
+func (tr *tree[V]) Prefixes() iter.Seq[netip.Prefix] {
+	return func(yield func(netip.Prefix) bool) {
+		for p := range tr.All() {
+			if !yield(p) {
+				return
+			}
+		}
+	}
+}
+
+// Descendants iterates over every stored prefix inside p, p included.
+// Unlike Children, p need not be covered by anything stored.
+func (tr *tree[V]) Descendants(p netip.Prefix) iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		ipType, k, err := tr.resolve(p)
+		if err != nil {
+			return
+		}
+		if start := subtree(tr.root(ipType), k); start != nil {
+			walk(start, func(n *node[V]) bool {
+				return yield(n.cidr(ipType), n.value)
+			})
+		}
+	}
+}
+
+// Ancestors iterates over every stored prefix containing p, p included,
+// least specific first.
+func (tr *tree[V]) Ancestors(p netip.Prefix) iter.Seq2[netip.Prefix, V] {
+	return func(yield func(netip.Prefix, V) bool) {
+		ipType, k, err := tr.resolve(p)
+		if err != nil {
+			return
+		}
+		for n := tr.root(ipType); n != nil && n.key.contains(k); n = n.child(k) {
+			if n.set && !yield(n.cidr(ipType), n.value) {
+				return
+			}
+		}
+	}
+}
+
+// walk calls yield for every valued node below n (n included) in
+// canonical order, stopping early once yield returns false.
+func walk[V any](n *node[V], yield func(*node[V]) bool) bool {
+	if n.set && !yield(n) {
+		return false
+	}
+	for _, c := range n.children {
+		if c != nil && !walk(c, yield) {
+			return false
+		}
+	}
+	return true
+}
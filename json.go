@@ -0,0 +1,109 @@
+package pytricia
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+)
+
+// jsonItem is one element of the JSON form: [{"prefix":..,"value":..}].
+type jsonItem[V any] struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Value  V            `json:"value"`
+}
+
+// WithJSONDecoder sets how UnmarshalJSON decodes each value, in place
+// of json.Unmarshal into a V. A PyTricia, say, can use it to get
+// concrete types instead of map[string]any and float64. Its type must
+// match the trie's value type.
+func WithJSONDecoder[V any](decode func(data json.RawMessage) (V, error)) Option {
+	return func(o *options) { o.jsonDecoder = decode }
+}
+
+// MarshalJSON implements json.Marshaler: the trie becomes an array of
+// {"prefix": ..., "value": ...} objects in canonical order.
+func (t *Trie[V]) MarshalJSON() ([]byte, error) { return t.load().MarshalJSON() }
+
+// MarshalText implements encoding.TextMarshaler: one line per prefix in
+// canonical order, the prefix and its value as JSON, tab-separated.
+func (t *Trie[V]) MarshalText() ([]byte, error) { return t.load().MarshalText() }
+
+// UnmarshalJSON implements json.Unmarshaler: it replaces the trie's
+// contents with those of a MarshalJSON array, as one write. The array
+// need not be sorted, but a prefix may appear only once.
+func (t *Trie[V]) UnmarshalJSON(data []byte) error {
+	next := newTree[V](t.load().cfg)
+	if err := next.unmarshalJSON(data); err != nil {
+		return err
+	}
+	t.replace(next)
+	return nil
+}
+
+// MarshalJSON encodes the version; see Trie.MarshalJSON.
+func (tr *tree[V]) MarshalJSON() ([]byte, error) {
+	items := []jsonItem[V]{}
+	for p, v := range tr.All() {
+		items = append(items, jsonItem[V]{Prefix: p, Value: v})
+	}
+	return json.Marshal(items)
+}
+
+// MarshalText encodes the version; see Trie.MarshalText.
+func (tr *tree[V]) MarshalText() ([]byte, error) {
+	var buf bytes.Buffer
+	for p, v := range tr.All() {
+		value, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("value of %v: %w", p, err)
+		}
+		fmt.Fprintf(&buf, "%v\t%s\n", p, value)
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalJSON fills the empty version tr from a MarshalJSON array.
+func (tr *tree[V]) unmarshalJSON(data []byte) error {
+	var items []struct {
+		Prefix string          `json:"prefix"`
+		Value  json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+
+	decode := func(data json.RawMessage) (V, error) {
+		var v V
+		err := json.Unmarshal(data, &v)
+		return v, err
+	}
+	switch d := tr.cfg.jsonDecoder.(type) {
+	case nil:
+	case func(json.RawMessage) (V, error):
+		decode = d
+	default:
+		var zero V
+		return fmt.Errorf("JSON decoder %T cannot produce %T values", d, zero)
+	}
+
+	cur := tr
+	for _, item := range items {
+		p, err := parseCIDR(item.Prefix)
+		if err != nil {
+			return err
+		}
+		if item.Value == nil {
+			item.Value = json.RawMessage("null")
+		}
+		v, err := decode(item.Value)
+		if err != nil {
+			return fmt.Errorf("value of %v: %w", item.Prefix, err)
+		}
+		if cur, _, err = cur.put(p, v, create); err != nil {
+			return err
+		}
+	}
+	tr.v4, tr.v6 = cur.v4, cur.v6
+	return nil
+}
@@ -0,0 +1,110 @@
+package pytricia
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+)
+
+// key is a prefix stored as left-aligned address bits plus a length.
+// IPv4 addresses occupy the top 32 bits of hi; host bits are always zero.
+type key struct {
+	hi, lo uint64
+	plen   uint8
+}
+
+// newKey builds the key for a prefix, masking off any host bits.
+func newKey(p netip.Prefix) key {
+	var k key
+	if a := p.Addr(); a.Is4() {
+		b := a.As4()
+		k.hi = uint64(binary.BigEndian.Uint32(b[:])) << 32
+	} else {
+		b := a.As16()
+		k.hi = binary.BigEndian.Uint64(b[:8])
+		k.lo = binary.BigEndian.Uint64(b[8:])
+	}
+	return k.truncate(p.Bits())
+}
+
+// bit returns the i-th bit (0-based, from the left) of the key.
+func (k key) bit(i int) int {
+	if i < 64 {
+		return int(k.hi>>(63-uint(i))) & 1
+	}
+	return int(k.lo>>(127-uint(i))) & 1
+}
+
+// truncate shortens the key to n bits, zeroing everything past them.
+func (k key) truncate(n int) key {
+	switch {
+	case n == 0:
+		k.hi, k.lo = 0, 0
+	case n <= 64:
+		k.hi &= ^uint64(0) << (64 - uint(n))
+		k.lo = 0
+	default:
+		k.lo &= ^uint64(0) << (128 - uint(n))
+	}
+	k.plen = uint8(n)
+	return k
+}
+
+// extend returns k one bit longer, that bit set to b.
+func (k key) extend(b int) key {
+	if b == 1 {
+		if k.plen < 64 {
+			k.hi |= 1 << (63 - uint(k.plen))
+		} else {
+			k.lo |= 1 << (127 - uint(k.plen))
+		}
+	}
+	k.plen++
+	return k
+}
+
+// commonLen returns how many leading bits k and o share, capped at the
+// shorter of the two lengths.
+func (k key) commonLen(o key) int {
+	n := 64 + bits.LeadingZeros64(k.lo^o.lo)
+	if x := k.hi ^ o.hi; x != 0 {
+		n = bits.LeadingZeros64(x)
+	}
+	if int(k.plen) < n {
+		n = int(k.plen)
+	}
+	if int(o.plen) < n {
+		n = int(o.plen)
+	}
+	return n
+}
+
+// contains reports whether o lies inside (or equals) k.
+func (k key) contains(o key) bool {
+	return k.plen <= o.plen && k.commonLen(o) == int(k.plen)
+}
+
+// prefix renders the key as a netip.Prefix of the given family (4 or 6).
+func (k key) prefix(ipType int) netip.Prefix {
+	if ipType == 4 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(k.hi>>32))
+		return netip.PrefixFrom(netip.AddrFrom4(b), int(k.plen))
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], k.hi)
+	binary.BigEndian.PutUint64(b[8:], k.lo)
+	return netip.PrefixFrom(netip.AddrFrom16(b), int(k.plen))
+}
+
+// keyLess orders two keys of one family canonically: address first,
+// then the shorter prefix first.
+func keyLess(a, b key) bool {
+	if a.hi != b.hi {
+		return a.hi < b.hi
+	}
+	if a.lo != b.lo {
+		return a.lo < b.lo
+	}
+	return a.plen < b.plen
+}
@@ -1,93 +1,119 @@
 package pytricia
 
-// ToMap: snapshot of every <CIDR,value> in the trie.
-func (t *PyTricia) ToMap() map[string]interface{} {
-	out := make(map[string]interface{})
-	if t == nil {
-		return out
-	}
+import "net/netip"
 
-	// Pin the root briefly.
-	t.mutex.RLock()
-	start := t
-	t.mutex.RUnlock()
+// Keys, Values and Items share one ordering contract, the canonical
+// order of the iterators: IPv4 before IPv6, then address ascending, and
+// a shorter prefix before a longer one at the same address. ToMap and
+// Children hand back Go maps and carry no order at all; use Items or
+// ChildrenSorted where output has to be stable.
 
-	stack := []*PyTricia{start}
-	for len(stack) > 0 {
-		n := stack[len(stack)-1]
-		stack = stack[:len(stack)-1]
+// Item is a single <prefix,value> pair of ordered output.
+type Item[V any] struct {
+	Prefix netip.Prefix
+	Value  V
+}
 
-		if v := n.value; v != nil {
-			if c := n.cidr(); c != nil {
-				out[c.String()] = v
-			}
-		}
-		if r := n.children[1]; r != nil {
-			stack = append(stack, r)
-		}
-		if l := n.children[0]; l != nil {
-			stack = append(stack, l)
-		}
+// ToMap: snapshot of every <prefix,value> in the trie (unordered).
+func (t *Trie[V]) ToMap() map[netip.Prefix]V {
+	if t == nil {
+		return make(map[netip.Prefix]V)
 	}
-	return out
+	return t.load().ToMap()
 }
 
-// Keys: every CIDR stored in the trie.
-func (t *PyTricia) Keys() []string {
-	keys := []string{}
+// Keys: every CIDR stored in the trie, in canonical order.
+func (t *Trie[V]) Keys() []string {
 	if t == nil {
-		return keys
+		return []string{}
 	}
+	return t.load().Keys()
+}
 
-	t.mutex.RLock()
-	start := t
-	t.mutex.RUnlock()
+// Values: every stored value (order parallels Keys()).
+func (t *Trie[V]) Values() []V {
+	if t == nil {
+		return []V{}
+	}
+	return t.load().Values()
+}
 
-	stack := []*PyTricia{start}
-	for len(stack) > 0 {
-		n := stack[len(stack)-1]
-		stack = stack[:len(stack)-1]
+// Items: every <prefix,value> pair, in canonical order.
+func (t *Trie[V]) Items() []Item[V] {
+	if t == nil {
+		return []Item[V]{}
+	}
+	return t.load().Items()
+}
 
-		if n.value != nil {
-			if c := n.cidr(); c != nil {
-				keys = append(keys, c.String())
-			}
-		}
-		if r := n.children[1]; r != nil {
-			stack = append(stack, r)
-		}
-		if l := n.children[0]; l != nil {
-			stack = append(stack, l)
-		}
+// ToMap: snapshot of every <CIDR,value> in the trie (unordered).
+func (t *PyTricia) ToMap() map[string]interface{} {
+	out := make(map[string]interface{})
+	if t == nil {
+		return out
 	}
-	return keys
+	for key, value := range t.Trie.All() {
+		out[key.String()] = value
+	}
+	return out
+}
+
+// Keys: every CIDR stored in the trie, in canonical order.
+func (t *PyTricia) Keys() []string {
+	if t == nil {
+		return []string{}
+	}
+	return t.Trie.Keys()
 }
 
 // Values: every stored value (order parallels Keys()).
 func (t *PyTricia) Values() []interface{} {
-	vals := []interface{}{}
 	if t == nil {
-		return vals
+		return []interface{}{}
 	}
+	return t.Trie.Values()
+}
 
-	t.mutex.RLock()
-	start := t
-	t.mutex.RUnlock()
+// Items: every <prefix,value> pair, in canonical order.
+func (t *PyTricia) Items() []Item[any] {
+	if t == nil {
+		return []Item[any]{}
+	}
+	return t.Trie.Items()
+}
 
-	stack := []*PyTricia{start}
-	for len(stack) > 0 {
-		n := stack[len(stack)-1]
-		stack = stack[:len(stack)-1]
+// ToMap: snapshot of every <prefix,value> in the trie (unordered).
+func (tr *tree[V]) ToMap() map[netip.Prefix]V {
+	out := make(map[netip.Prefix]V)
+	for p, v := range tr.All() {
+		out[p] = v
+	}
+	return out
+}
 
-		if v := n.value; v != nil {
-			vals = append(vals, v)
-		}
-		if r := n.children[1]; r != nil {
-			stack = append(stack, r)
-		}
-		if l := n.children[0]; l != nil {
-			stack = append(stack, l)
-		}
+// Keys: every CIDR stored in the trie, in canonical order.
+func (tr *tree[V]) Keys() []string {
+	keys := []string{}
+	for p := range tr.Prefixes() {
+		keys = append(keys, p.String())
+	}
+	return keys
+}
+
+// Values: every stored value (order parallels Keys()).
+func (tr *tree[V]) Values() []V {
+	vals := []V{}
+	for _, v := range tr.All() {
+		vals = append(vals, v)
 	}
 	return vals
 }
+
+// Items: every <prefix,value> pair, in canonical order.
+func (tr *tree[V]) Items() []Item[V] {
+	items := []Item[V]{}
+	for p, v := range tr.All() {
+		items = append(items, Item[V]{Prefix: p, Value: v})
+	}
+	return items
+}
@@ -0,0 +1,484 @@
+package pytricia
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"os"
+	"sync/atomic"
+)
+
+// Mapped format, version 1: the trie flattened into fixed-size records
+// that refer to each other by index, so a file can be mapped into memory
+// and searched where it lies. Integers are big-endian.
+//
+//	header  32 bytes: magic "PYTM", version, 3 zero bytes, node count
+//	        (uint32), index of the IPv6 root (uint32), length of the
+//	        value section (uint64), 8 zero bytes
+//	nodes   40 bytes each, both families in pre-order, IPv4 first
+//	values  the value section
+//
+// A node record holds the key's bits, left-aligned (16 bytes), its
+// length, a flags byte, 2 zero bytes, the indexes of its 0 and 1
+// children (uint32, 0 for none), and the length (uint32) and offset
+// (uint64) of its value in the value section. There the original key's
+// address (16 bytes, left-aligned) comes first, if flagged.
+const (
+	mappedMagic   = "PYTM"
+	mappedVersion = 1
+	mappedHeader  = 32
+	mappedNode    = 40
+)
+
+// WriteMapped writes the trie in the mapped format, for OpenMappedTrie.
+// Values are encoded with the trie's codec.
+func (t *Trie[V]) WriteMapped(w io.Writer) (int64, error) { return t.load().WriteMapped(w) }
+
+// WriteMapped encodes the version; see Trie.WriteMapped.
+func (tr *tree[V]) WriteMapped(w io.Writer) (int64, error) {
+	codec, err := tr.codec()
+	if err != nil {
+		return 0, err
+	}
+	f := &flattener[V]{codec: codec}
+	if _, err := f.node(tr.v4, 4); err != nil {
+		return 0, err
+	}
+	v6, err := f.node(tr.v6, 6)
+	if err != nil {
+		return 0, err
+	}
+
+	head := make([]byte, mappedHeader)
+	copy(head, mappedMagic)
+	head[4] = mappedVersion
+	binary.BigEndian.PutUint32(head[8:], uint32(len(f.nodes)/mappedNode))
+	binary.BigEndian.PutUint32(head[12:], v6)
+	binary.BigEndian.PutUint64(head[16:], uint64(len(f.values)))
+
+	cw := &countingWriter{w: w}
+	for _, b := range [][]byte{head, f.nodes, f.values} {
+		if _, err := cw.Write(b); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// flattener lays out node records and values in memory.
+type flattener[V any] struct {
+	codec  Codec[V]
+	nodes  []byte
+	values []byte
+}
+
+// node appends the records of the subtree n and returns its index.
+func (f *flattener[V]) node(n *node[V], ipType int) (uint32, error) {
+	if n == nil {
+		n = &node[V]{} // an empty family
+	}
+	at := len(f.nodes)
+	if at/mappedNode >= math.MaxUint32 {
+		return 0, fmt.Errorf("%w: too many nodes for the mapped format", ErrBadFormat)
+	}
+	f.nodes = binary.BigEndian.AppendUint64(f.nodes, n.key.hi)
+	f.nodes = binary.BigEndian.AppendUint64(f.nodes, n.key.lo)
+	f.nodes = append(f.nodes, n.key.plen, 0, 0, 0)
+	f.nodes = append(f.nodes, make([]byte, mappedNode-20)...)
+	rec := func() []byte { return f.nodes[at : at+mappedNode] }
+
+	if n.set {
+		var flags byte = flagValue
+		off := uint64(len(f.values))
+		if n.orig != nil {
+			flags |= flagOrig
+			o := newKey(netip.PrefixFrom(n.orig.Addr(), n.orig.Addr().BitLen()))
+			f.values = binary.BigEndian.AppendUint64(f.values, o.hi)
+			f.values = binary.BigEndian.AppendUint64(f.values, o.lo)
+		}
+		data, err := f.codec.Encode(n.value)
+		if err != nil {
+			return 0, fmt.Errorf("encoding value of %v: %w", n.cidr(ipType), err)
+		}
+		if uint64(len(data)) > math.MaxUint32 {
+			return 0, fmt.Errorf("value of %v too large for the mapped format", n.cidr(ipType))
+		}
+		f.values = append(f.values, data...)
+		rec()[17] = flags
+		binary.BigEndian.PutUint32(rec()[28:], uint32(len(data)))
+		binary.BigEndian.PutUint64(rec()[32:], off)
+	}
+	for b, c := range n.children {
+		if c == nil {
+			continue
+		}
+		i, err := f.node(c, ipType)
+		if err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint32(rec()[20+4*b:], i)
+	}
+	return uint32(at / mappedNode), nil
+}
+
+// MappedTrie is a read-only trie searched in place in the mapped format,
+// typically straight from a memory-mapped file: opening one costs no
+// parsing and no allocation per prefix, and the operating system shares
+// and pages the file as it sees fit. Lookups answer exactly as the Trie
+// that was written would; only values are decoded, on the way out.
+//
+// A MappedTrie is safe for concurrent use. It must not be used once
+// closed. Records are checked as lookups reach them, not at open: a
+// damaged one reads as missing, and Err reports it.
+type MappedTrie[V any] struct {
+	nodes  []byte
+	values []byte
+	v6     uint32 // index of the IPv6 root
+	cfg    *options
+	codec  Codec[V]
+	close  func() error
+	fault  *atomic.Pointer[error] // the first damaged record a lookup met
+}
+
+// OpenMappedTrie maps the file at path, as written by WriteMapped, into
+// memory. opts must configure the codec the file was written with;
+// key modes and embedded-IPv4 policies apply to lookups as they would
+// in a Trie. On platforms without mmap the file is read instead.
+func OpenMappedTrie[V any](path string, opts ...Option) (*MappedTrie[V], error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < mappedHeader || info.Size() != int64(int(info.Size())) {
+		return nil, fmt.Errorf("%w: %s: bad size %d", ErrBadFormat, path, info.Size())
+	}
+	data, unmap, err := mapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	m, err := NewMappedTrie[V](data, opts...)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	m.close = unmap
+	return m, nil
+}
+
+// NewMappedTrie searches data, in the mapped format, in place; data
+// must not change while the MappedTrie is in use.
+func NewMappedTrie[V any](data []byte, opts ...Option) (*MappedTrie[V], error) {
+	cfg := newOptions(opts)
+	codec, err := codecOf[V](cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < mappedHeader || string(data[:4]) != mappedMagic {
+		return nil, fmt.Errorf("%w: not a mapped trie", ErrBadFormat)
+	}
+	if data[4] != mappedVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadFormat, data[4])
+	}
+	count := uint64(binary.BigEndian.Uint32(data[8:]))
+	v6 := binary.BigEndian.Uint32(data[12:])
+	size := binary.BigEndian.Uint64(data[16:])
+	nodesEnd := mappedHeader + count*mappedNode
+	if nodesEnd > uint64(len(data)) || uint64(len(data))-nodesEnd != size {
+		return nil, fmt.Errorf("%w: sections do not match the file size", ErrBadFormat)
+	}
+	m := &MappedTrie[V]{
+		nodes:  data[mappedHeader:nodesEnd],
+		values: data[nodesEnd:],
+		v6:     v6,
+		cfg:    cfg,
+		codec:  codec,
+		fault:  new(atomic.Pointer[error]),
+	}
+	if v6 == 0 || uint64(v6) >= count || m.node(0).key.plen != 0 || m.node(v6).key.plen != 0 {
+		return nil, fmt.Errorf("%w: bad family roots", ErrBadFormat)
+	}
+	return m, nil
+}
+
+// Err returns the first error a lookup met reading a value – one lying
+// outside the value section or that the codec cannot decode – or nil.
+// Such a lookup reports the entry as missing, so a caller that must
+// tell a damaged file from a missing key checks Err, as it would the
+// error of ReadFrom.
+func (m *MappedTrie[V]) Err() error {
+	if err := m.fault.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// Close unmaps the file; it is a no-op for a NewMappedTrie.
+func (m *MappedTrie[V]) Close() error {
+	if m.close == nil {
+		return nil
+	}
+	unmap := m.close
+	m.close = nil
+	return unmap()
+}
+
+// flatNode is one node record, read out of the mapping.
+type flatNode struct {
+	key      key
+	flags    byte
+	children [2]uint32
+	size     uint32 // of the value
+	off      uint64 // of the value
+}
+
+// node reads record i.
+func (m *MappedTrie[V]) node(i uint32) flatNode {
+	rec := m.nodes[uint64(i)*mappedNode:][:mappedNode]
+	return flatNode{
+		key: key{
+			hi:   binary.BigEndian.Uint64(rec[0:]),
+			lo:   binary.BigEndian.Uint64(rec[8:]),
+			plen: rec[16],
+		},
+		flags:    rec[17],
+		children: [2]uint32{binary.BigEndian.Uint32(rec[20:]), binary.BigEndian.Uint32(rec[24:])},
+		size:     binary.BigEndian.Uint32(rec[28:]),
+		off:      binary.BigEndian.Uint64(rec[32:]),
+	}
+}
+
+// path calls visit on each node from the family root down to k, as far
+// as they contain k. Since children come after their parent, a record
+// pointing anywhere else ends the walk, so a corrupt file cannot loop.
+func (m *MappedTrie[V]) path(ipType int, k key, visit func(i uint32, n flatNode)) {
+	i, end := uint32(0), m.v6
+	if ipType == 6 {
+		i, end = m.v6, uint32(len(m.nodes)/mappedNode)
+	}
+	for {
+		n := m.node(i)
+		if !n.key.contains(k) {
+			return
+		}
+		visit(i, n)
+		if k.plen <= n.key.plen {
+			return
+		}
+		c := n.children[k.bit(int(n.key.plen))]
+		if c <= i || c >= end {
+			return
+		}
+		i = c
+	}
+}
+
+// item decodes the prefix and value of the valued node n; ok is false,
+// and Err set, if its value lies outside the value section or does not
+// decode.
+func (m *MappedTrie[V]) item(ipType int, n flatNode) (p netip.Prefix, value V, ok bool) {
+	p, start := n.key.prefix(ipType), n.off
+	outside := func() (netip.Prefix, V, bool) {
+		return p, value, m.fail(fmt.Errorf("%w: value of %v lies outside the value section", ErrBadFormat, p))
+	}
+	if n.flags&flagOrig != 0 {
+		if start > uint64(len(m.values)) || uint64(len(m.values))-start < 16 {
+			return outside()
+		}
+		o := m.values[start : start+16]
+		a := netip.AddrFrom16([16]byte(o))
+		if ipType == 4 {
+			a = netip.AddrFrom4([4]byte(o))
+		}
+		p, start = netip.PrefixFrom(a, int(n.key.plen)), start+16
+	}
+	if start > uint64(len(m.values)) || uint64(len(m.values))-start < uint64(n.size) {
+		return outside()
+	}
+	value, err := m.codec.Decode(m.values[start : start+uint64(n.size)])
+	if err != nil {
+		return p, value, m.fail(fmt.Errorf("%w: decoding value of %v: %w", ErrBadFormat, p, err))
+	}
+	return p, value, true
+}
+
+// fail records err for Err, unless an earlier error is there already,
+// and returns false.
+func (m *MappedTrie[V]) fail(err error) bool {
+	m.fault.CompareAndSwap(nil, &err)
+	return false
+}
+
+// LookupPrefix: longest-prefix match for a netip.Prefix, returning the
+// stored key and value; ok is false when nothing covers p.
+func (m *MappedTrie[V]) LookupPrefix(p netip.Prefix) (key netip.Prefix, value V, ok bool) {
+	ipType, k, err := m.cfg.resolve(p)
+	if err != nil {
+		return netip.Prefix{}, value, false
+	}
+	var best flatNode
+	found := false
+	m.path(ipType, k, func(_ uint32, n flatNode) {
+		if n.flags&flagValue != 0 {
+			best, found = n, true
+		}
+	})
+	if !found {
+		return netip.Prefix{}, value, false
+	}
+	return m.item(ipType, best)
+}
+
+// LookupAddr: longest-prefix match for a single address
+func (m *MappedTrie[V]) LookupAddr(a netip.Addr) (key netip.Prefix, value V, ok bool) {
+	return m.LookupPrefix(netip.PrefixFrom(a, a.BitLen()))
+}
+
+// GetPrefix: Get for a netip.Prefix
+func (m *MappedTrie[V]) GetPrefix(p netip.Prefix) (V, bool) {
+	_, value, ok := m.LookupPrefix(p)
+	return value, ok
+}
+
+// ContainsAddr: does an address resolve to *anything*?
+func (m *MappedTrie[V]) ContainsAddr(a netip.Addr) bool {
+	_, _, ok := m.LookupAddr(a)
+	return ok
+}
+
+// HasPrefix: exact-match test for a netip.Prefix
+func (m *MappedTrie[V]) HasPrefix(p netip.Prefix) bool {
+	ipType, k, err := m.cfg.resolve(p)
+	if err != nil {
+		return false
+	}
+	has := false
+	m.path(ipType, k, func(_ uint32, n flatNode) {
+		has = n.key == k && n.flags&flagValue != 0
+	})
+	return has
+}
+
+// Covering: GetAll for a netip.Prefix.
+func (m *MappedTrie[V]) Covering(p netip.Prefix) []Item[V] {
+	out := []Item[V]{}
+	ipType, k, err := m.cfg.resolve(p)
+	if err != nil {
+		return out
+	}
+	m.path(ipType, k, func(_ uint32, n flatNode) {
+		if n.flags&flagValue == 0 {
+			return
+		}
+		if p, value, ok := m.item(ipType, n); ok {
+			out = append(out, Item[V]{Prefix: p, Value: value})
+		}
+	})
+
+	// The walk runs root-down; flip it to most specific first.
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// Get: longest-prefix match – returns the stored value and whether
+// anything matched at all
+func (m *MappedTrie[V]) Get(cidr string) (V, bool) {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		var zero V
+		return zero, false
+	}
+	return m.GetPrefix(p)
+}
+
+// GetKey: returns the CIDR string that actually stored the value
+func (m *MappedTrie[V]) GetKey(cidr string) string {
+	if key, _, ok := m.lookupString(cidr); ok {
+		return key.String()
+	}
+	return ""
+}
+
+// GetKV: key + value in one call (avoids 2× parseCIDR)
+func (m *MappedTrie[V]) GetKV(cidr string) (string, V, bool) {
+	if key, value, ok := m.lookupString(cidr); ok {
+		return key.String(), value, true
+	}
+	var zero V
+	return "", zero, false
+}
+
+// Contains: does a prefix (or IP) resolve to *anything*?
+func (m *MappedTrie[V]) Contains(cidr string) bool {
+	_, ok := m.Get(cidr)
+	return ok
+}
+
+// HasKey: exact-match test (node must *store* a value at that prefix)
+func (m *MappedTrie[V]) HasKey(cidr string) bool {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	return m.HasPrefix(p)
+}
+
+// GetAll returns every stored prefix covering cidr, most specific first.
+func (m *MappedTrie[V]) GetAll(cidr string) []Item[V] {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		return []Item[V]{}
+	}
+	return m.Covering(p)
+}
+
+// lookupString: parseCIDR + LookupPrefix for the string API
+func (m *MappedTrie[V]) lookupString(cidr string) (netip.Prefix, V, bool) {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		var zero V
+		return netip.Prefix{}, zero, false
+	}
+	return m.LookupPrefix(p)
+}
+
+// MappedPyTricia is the untyped MappedTrie: its lookups report a missing
+// entry as a nil value, as PyTricia's do.
+type MappedPyTricia struct {
+	MappedTrie[any]
+}
+
+// OpenMappedPyTricia: OpenMappedTrie for a file written from a PyTricia.
+func OpenMappedPyTricia(path string, opts ...Option) (*MappedPyTricia, error) {
+	m, err := OpenMappedTrie[any](path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &MappedPyTricia{*m}, nil
+}
+
+// Get: longest-prefix match – returns the stored value (or nil)
+func (m *MappedPyTricia) Get(cidr string) interface{} {
+	value, _ := m.MappedTrie.Get(cidr)
+	return value
+}
+
+// GetKV: key + value in one call (avoids 2× parseCIDR)
+func (m *MappedPyTricia) GetKV(cidr string) (string, interface{}) {
+	key, value, _ := m.MappedTrie.GetKV(cidr)
+	return key, value
+}
+
+// GetPrefix: Get for a netip.Prefix
+func (m *MappedPyTricia) GetPrefix(p netip.Prefix) interface{} {
+	value, _ := m.MappedTrie.GetPrefix(p)
+	return value
+}
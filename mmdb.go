@@ -0,0 +1,748 @@
+package pytricia
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/netip"
+	"slices"
+)
+
+// MaxMind DB format, version 2.0: a binary search tree over address
+// bits whose records point to further nodes or into a data section of
+// typed values, then a metadata map behind a marker. In an IPv6
+// database IPv4 addresses live under ::/96. See
+// https://maxmind.github.io/MaxMind-DB/.
+const (
+	mmdbMarker    = "\xab\xcd\xefMaxMind.com"
+	mmdbMaxSearch = 128 << 10 // how far from the end the marker may lie
+	mmdbMaxDepth  = 512       // of nested maps, arrays and pointers
+	mmdbMaxSize   = 65821 + 1<<24 - 1
+)
+
+// Data section types.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// MMDBMetadata describes a MaxMind DB file.
+type MMDBMetadata struct {
+	DatabaseType string
+	Description  map[string]string // by language
+	Languages    []string
+	IPVersion    int    // 4 or 6; WriteMMDB takes 0 as 6
+	RecordSize   int    // in bits: 24, 28 or 32; WriteMMDB takes 0 as the smallest that fits
+	NodeCount    int    // set by ReadMMDB
+	BuildEpoch   uint64 // seconds since the Unix epoch
+}
+
+// ReadMMDB reads a MaxMind DB file into a PyTricia, one prefix per
+// network with data, values decoded into map[string]any and the like
+// (uint16/32/64 as uint64, int32 as int, uint128 as *big.Int, float as
+// float32). Networks sharing a record share one value. In an IPv6
+// database the networks under ::/96 become IPv4 prefixes, and the
+// aliases some writers add for that subtree are skipped. opts configure
+// the trie.
+func ReadMMDB(r io.Reader, opts ...Option) (*PyTricia, *MMDBMetadata, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := openMMDB(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		items []Item[any]
+		werr  error
+	)
+	db.networks(func(p netip.Prefix, off uint64) bool {
+		var v any
+		if v, werr = db.value(off); werr == nil {
+			items = append(items, Item[any]{Prefix: p, Value: v})
+		}
+		return werr == nil
+	}, &werr)
+	if werr != nil {
+		return nil, nil, werr
+	}
+	t, err := BulkLoad(items, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	pt := &PyTricia{}
+	pt.root.Store(t.load())
+	return pt, &db.meta, nil
+}
+
+// mmdb is a MaxMind DB file being read.
+type mmdb struct {
+	meta   MMDBMetadata
+	tree   []byte
+	data   mmdbDecoder
+	values map[uint64]any // decoded, by data section offset
+}
+
+// openMMDB checks data's metadata and splits it into its sections.
+func openMMDB(data []byte) (*mmdb, error) {
+	bad := func(why string, args ...any) (*mmdb, error) {
+		return nil, fmt.Errorf("%w: MMDB: %s", ErrBadFormat, fmt.Sprintf(why, args...))
+	}
+	at := bytes.LastIndex(data[max(0, len(data)-mmdbMaxSearch):], []byte(mmdbMarker))
+	if at < 0 {
+		return bad("no metadata")
+	}
+	at += max(0, len(data)-mmdbMaxSearch)
+	raw, _, err := (&mmdbDecoder{data: data[at+len(mmdbMarker):]}).decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := raw.(map[string]any)
+	if !ok {
+		return bad("metadata is a %T", raw)
+	}
+	field := func(name string) int {
+		v, _ := m[name].(uint64)
+		return int(min(v, math.MaxInt32))
+	}
+	db := &mmdb{
+		meta: MMDBMetadata{
+			IPVersion:  field("ip_version"),
+			RecordSize: field("record_size"),
+			NodeCount:  field("node_count"),
+		},
+		values: make(map[uint64]any),
+	}
+	db.meta.DatabaseType, _ = m["database_type"].(string)
+	db.meta.BuildEpoch, _ = m["build_epoch"].(uint64)
+	if d, ok := m["description"].(map[string]any); ok {
+		db.meta.Description = make(map[string]string, len(d))
+		for lang, s := range d {
+			db.meta.Description[lang], _ = s.(string)
+		}
+	}
+	if l, ok := m["languages"].([]any); ok {
+		for _, s := range l {
+			if s, ok := s.(string); ok {
+				db.meta.Languages = append(db.meta.Languages, s)
+			}
+		}
+	}
+
+	if v := field("binary_format_major_version"); v != 2 {
+		return bad("unsupported format version %d", v)
+	}
+	if v := db.meta.IPVersion; v != 4 && v != 6 {
+		return bad("bad IP version %d", v)
+	}
+	if v := db.meta.RecordSize; v != 24 && v != 28 && v != 32 {
+		return bad("bad record size %d", v)
+	}
+	size := uint64(db.meta.NodeCount) * uint64(db.meta.RecordSize) / 4
+	if db.meta.NodeCount == 0 || size+16 > uint64(at) {
+		return bad("search tree of %d nodes does not fit", db.meta.NodeCount)
+	}
+	db.tree = data[:size]
+	db.data = mmdbDecoder{data: data[size+16 : at], cache: make(map[uint64]any)}
+	return db, nil
+}
+
+// record returns record b (0 or 1) of node i.
+func (db *mmdb) record(i, b int) uint64 {
+	switch n := db.tree[i*db.meta.RecordSize/4:]; db.meta.RecordSize {
+	case 24:
+		n = n[3*b:]
+		return uint64(n[0])<<16 | uint64(n[1])<<8 | uint64(n[2])
+	case 28:
+		hi := uint64(n[3] >> 4)
+		if b == 1 {
+			hi, n = uint64(n[3]&0x0f), n[4:]
+		}
+		return hi<<24 | uint64(n[0])<<16 | uint64(n[1])<<8 | uint64(n[2])
+	default:
+		return uint64(binary.BigEndian.Uint32(n[4*b:]))
+	}
+}
+
+// networks calls yield for every network with data, in canonical order,
+// with the data's offset. A malformed tree stops it with *err set.
+func (db *mmdb) networks(yield func(p netip.Prefix, off uint64) bool, err *error) {
+	count := uint64(db.meta.NodeCount)
+	seen := make([]bool, count)
+	v4 := uint64(math.MaxUint64) // the node at ::/96, in an IPv6 database
+
+	// walk visits the subtree of record r at the prefix k.
+	var walk func(ipType int, r uint64, k key) bool
+	walk = func(ipType int, r uint64, k key) bool {
+		switch {
+		case r == count:
+			return true
+		case r > count:
+			off := r - count - 16
+			if r-count < 16 || off >= uint64(len(db.data.data)) {
+				*err = fmt.Errorf("%w: MMDB: record of %v points outside the data", ErrBadFormat, k.prefix(ipType))
+				return false
+			}
+			return yield(k.prefix(ipType), off)
+		case r == v4 && ipType == 6:
+			return true // an alias of the IPv4 subtree
+		case seen[r] || (ipType == 4 && k.plen >= 32) || k.plen >= 128:
+			*err = fmt.Errorf("%w: MMDB: search tree is not a tree at %v", ErrBadFormat, k.prefix(ipType))
+			return false
+		}
+		seen[r] = true
+		return walk(ipType, db.record(int(r), 0), k.extend(0)) &&
+			walk(ipType, db.record(int(r), 1), k.extend(1))
+	}
+
+	if db.meta.IPVersion == 4 {
+		walk(4, 0, key{})
+		return
+	}
+	// IPv4 first, found 96 zero bits down; a shorter network with data
+	// there covers all of it.
+	r := uint64(0)
+	for i := 0; i < 96 && r < count; i++ {
+		r = db.record(int(r), 0)
+	}
+	switch {
+	case r < count:
+		v4 = r
+		if !walk(4, r, key{}) {
+			return
+		}
+	case r > count:
+		if !walk(4, r, key{}) {
+			return
+		}
+	}
+	walk(6, 0, key{})
+}
+
+// value decodes the data at off, once per offset.
+func (db *mmdb) value(off uint64) (any, error) {
+	if v, ok := db.values[off]; ok {
+		return v, nil
+	}
+	v, _, err := db.data.decode(off, 0)
+	if err != nil {
+		return nil, err
+	}
+	db.values[off] = v
+	return v, nil
+}
+
+// mmdbDecoder decodes values of a data section.
+type mmdbDecoder struct {
+	data  []byte
+	cache map[uint64]any // pointer targets decoded, so each is decoded once
+}
+
+// decode decodes the value at off, at the given nesting depth, and
+// returns it with the offset just past it.
+func (d *mmdbDecoder) decode(off uint64, depth int) (any, uint64, error) {
+	bad := func(why string, args ...any) (any, uint64, error) {
+		return nil, 0, fmt.Errorf("%w: MMDB: data at %d: %s", ErrBadFormat, off, fmt.Sprintf(why, args...))
+	}
+	if depth > mmdbMaxDepth {
+		return bad("nested too deep")
+	}
+	typ, size, next, ok := d.control(off)
+	if !ok {
+		return bad("truncated")
+	}
+	if typ == mmdbPointer {
+		target, next, ok := d.pointer(off)
+		if !ok {
+			return bad("truncated pointer")
+		}
+		if v, ok := d.cache[target]; ok {
+			return v, next, nil
+		}
+		if t, _, _, ok := d.control(target); !ok || t == mmdbPointer {
+			return bad("bad pointer target %d", target)
+		}
+		v, _, err := d.decode(target, depth+1)
+		if err == nil && d.cache != nil {
+			d.cache[target] = v
+		}
+		return v, next, err
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]any, min(size, 64))
+		for range size {
+			k, n, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			s, ok := k.(string)
+			if !ok {
+				return bad("map key is a %T", k)
+			}
+			v, n, err := d.decode(n, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[s], next = v, n
+		}
+		return m, next, nil
+	case mmdbArray:
+		a := make([]any, 0, min(size, 64))
+		for range size {
+			v, n, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, next = append(a, v), n
+		}
+		return a, next, nil
+	case mmdbBool:
+		if size > 1 {
+			return bad("boolean of size %d", size)
+		}
+		return size == 1, next, nil
+	}
+
+	if uint64(len(d.data))-next < size {
+		return bad("truncated")
+	}
+	b := d.data[next : next+size]
+	next += size
+	switch typ {
+	case mmdbString:
+		return string(b), next, nil
+	case mmdbBytes:
+		return slices.Clone(b), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return bad("double of size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return bad("float of size %d", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	case mmdbUint16, mmdbUint32, mmdbInt32, mmdbUint64:
+		if limit := [...]uint64{mmdbUint16: 2, mmdbUint32: 4, mmdbInt32: 4, mmdbUint64: 8}[typ]; size > limit {
+			return bad("integer of size %d", size)
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if typ == mmdbInt32 {
+			return int(int32(uint32(v))), next, nil
+		}
+		return v, next, nil
+	case mmdbUint128:
+		if size > 16 {
+			return bad("integer of size %d", size)
+		}
+		return new(big.Int).SetBytes(b), next, nil
+	}
+	return bad("unsupported type %d", typ)
+}
+
+// control reads the control byte(s) at off: the value's type, its size
+// and the offset of its payload.
+func (d *mmdbDecoder) control(off uint64) (typ int, size, next uint64, ok bool) {
+	if off >= uint64(len(d.data)) {
+		return 0, 0, 0, false
+	}
+	c := d.data[off]
+	typ, size, next = int(c>>5), uint64(c&0x1f), off+1
+	if typ == mmdbPointer {
+		return typ, 0, next, true
+	}
+	if typ == mmdbExtended {
+		if next >= uint64(len(d.data)) {
+			return 0, 0, 0, false
+		}
+		typ, next = 7+int(d.data[next]), next+1
+		if typ <= 7 {
+			return 0, 0, 0, false
+		}
+	}
+	if size >= 29 {
+		n := size - 28 // 1 to 3 more bytes
+		if uint64(len(d.data))-next < n {
+			return 0, 0, 0, false
+		}
+		var v uint64
+		for _, c := range d.data[next : next+n] {
+			v = v<<8 | uint64(c)
+		}
+		size, next = v+[4]uint64{0, 29, 285, 65821}[n], next+n
+	}
+	return typ, size, next, true
+}
+
+// pointer reads the pointer at off and returns its target and the
+// offset past it.
+func (d *mmdbDecoder) pointer(off uint64) (target, next uint64, ok bool) {
+	c := d.data[off]
+	n := uint64(c>>3&3) + 1
+	if uint64(len(d.data))-off-1 < n {
+		return 0, 0, false
+	}
+	v := uint64(c & 7)
+	if n == 4 {
+		v = 0
+	}
+	for _, b := range d.data[off+1 : off+1+n] {
+		v = v<<8 | uint64(b)
+	}
+	return v + [5]uint64{0, 0, 2048, 526336, 0}[n], off + 1 + n, true
+}
+
+// WriteMMDB writes the trie as a MaxMind DB file described by meta.
+// Each prefix becomes a network whose addresses without a longer match
+// map to its value, so the database answers lookups as the trie does.
+// Values must be maps (map[string]any), slices ([]any), strings, []byte,
+// bools, floats, unsigned integers, *big.Int (as uint128), or signed
+// integers in int32 range. An IPv6 database holds the IPv4 prefixes
+// under ::/96, which must hold no IPv6 prefix, and IPv6 addresses there
+// read as IPv4 ones; an IPv4 database cannot hold IPv6 prefixes.
+func (t *Trie[V]) WriteMMDB(w io.Writer, meta MMDBMetadata) (int64, error) {
+	return t.load().WriteMMDB(w, meta)
+}
+
+// WriteMMDB encodes the version; see Trie.WriteMMDB.
+func (tr *tree[V]) WriteMMDB(w io.Writer, meta MMDBMetadata) (int64, error) {
+	if meta.IPVersion == 0 {
+		meta.IPVersion = 6
+	}
+	mw := &mmdbWriter[V]{offsets: make(map[string]uint64), leaves: make(map[*node[V]]uint64)}
+	switch meta.IPVersion {
+	case 4:
+		if v6 := tr.v6; v6 != nil && (v6.set || v6.children != [2]*node[V]{}) {
+			return 0, fmt.Errorf("IPv4 MMDB cannot hold IPv6 prefixes")
+		}
+		if _, err := mw.record(tr.v4, 4, tr.v4, key{}, nil); err != nil {
+			return 0, err
+		}
+	case 6:
+		if _, err := mw.record(tr.v4, 6, tr.v6, key{}, nil); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("bad MMDB IP version %d", meta.IPVersion)
+	}
+
+	// Records are written as node indexes, then node count for none,
+	// then node count + 16 + data offset.
+	count := uint64(len(mw.nodes))
+	top := count + 16 + uint64(len(mw.data))
+	if meta.RecordSize == 0 {
+		meta.RecordSize = 24
+		for meta.RecordSize < 32 && top >= 1<<meta.RecordSize {
+			meta.RecordSize += 4
+		}
+	}
+	switch {
+	case meta.RecordSize != 24 && meta.RecordSize != 28 && meta.RecordSize != 32:
+		return 0, fmt.Errorf("bad MMDB record size %d", meta.RecordSize)
+	case top >= 1<<meta.RecordSize:
+		return 0, fmt.Errorf("MMDB too large for %d-bit records", meta.RecordSize)
+	}
+	meta.NodeCount = int(count)
+
+	treeBytes := make([]byte, 0, len(mw.nodes)*meta.RecordSize/4)
+	for _, n := range mw.nodes {
+		var r [2]uint64
+		for b, rec := range n {
+			switch {
+			case rec == mmdbNone:
+				r[b] = count
+			case rec&mmdbData != 0:
+				r[b] = count + 16 + rec&^mmdbData
+			default:
+				r[b] = rec
+			}
+		}
+		switch meta.RecordSize {
+		case 24:
+			treeBytes = append(treeBytes, byte(r[0]>>16), byte(r[0]>>8), byte(r[0]),
+				byte(r[1]>>16), byte(r[1]>>8), byte(r[1]))
+		case 28:
+			treeBytes = append(treeBytes, byte(r[0]>>16), byte(r[0]>>8), byte(r[0]),
+				byte(r[0]>>24<<4|r[1]>>24), byte(r[1]>>16), byte(r[1]>>8), byte(r[1]))
+		default:
+			treeBytes = binary.BigEndian.AppendUint32(treeBytes, uint32(r[0]))
+			treeBytes = binary.BigEndian.AppendUint32(treeBytes, uint32(r[1]))
+		}
+	}
+
+	description := make(map[string]any, len(meta.Description))
+	for lang, s := range meta.Description {
+		description[lang] = s
+	}
+	languages := make([]any, len(meta.Languages))
+	for i, s := range meta.Languages {
+		languages[i] = s
+	}
+	metadata, err := appendMMDB(nil, map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 meta.BuildEpoch,
+		"database_type":               meta.DatabaseType,
+		"description":                 description,
+		"ip_version":                  uint16(meta.IPVersion),
+		"languages":                   languages,
+		"node_count":                  uint32(meta.NodeCount),
+		"record_size":                 uint16(meta.RecordSize),
+	}, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	cw := &countingWriter{w: w}
+	for _, b := range [][]byte{treeBytes, make([]byte, 16), mw.data, []byte(mmdbMarker), metadata} {
+		if _, err := cw.Write(b); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// Records of mmdbWriter.nodes, before the node count is known.
+const (
+	mmdbNone = math.MaxUint64 // no data
+	mmdbData = 1 << 62        // flags a data section offset
+)
+
+// mmdbWriter lays out the search tree and data section.
+type mmdbWriter[V any] struct {
+	nodes   [][2]uint64
+	data    []byte
+	offsets map[string]uint64   // of encoded values, so each is stored once
+	leaves  map[*node[V]]uint64 // records of valued nodes, already encoded
+}
+
+// ipv4Key is ::/96, where an IPv6 database keeps IPv4.
+var ipv4Key = key{plen: 96}
+
+// record returns the record for the prefix k of the given family: n is
+// the topmost trie node inside k, if any, and inherited the closest
+// valued node above. In an IPv6 database the IPv4 trie v4 is grafted at
+// ::/96.
+func (mw *mmdbWriter[V]) record(v4 *node[V], ipType int, n *node[V], k key, inherited *node[V]) (uint64, error) {
+	graft := ipType == 6 && v4 != nil
+	if graft && k == ipv4Key {
+		if n != nil {
+			return 0, fmt.Errorf("IPv6 prefix %v lies where MMDB keeps IPv4", n.cidr(6))
+		}
+		ipType, n, k, inherited, graft = 4, v4, key{}, nil, false
+	}
+	if n != nil && n.key == k {
+		if n.set {
+			inherited = n
+		}
+		if n.children == [2]*node[V]{} {
+			n = nil
+		}
+	}
+	if n == nil && !(graft && k.contains(ipv4Key)) {
+		return mw.leaf(inherited, ipType)
+	}
+
+	i := len(mw.nodes)
+	mw.nodes = append(mw.nodes, [2]uint64{})
+	for b := range 2 {
+		var next *node[V]
+		switch {
+		case n == nil:
+		case n.key == k:
+			next = n.children[b]
+		case n.key.bit(int(k.plen)) == b:
+			next = n
+		}
+		rec, err := mw.record(v4, ipType, next, k.extend(b), inherited)
+		if err != nil {
+			return 0, err
+		}
+		mw.nodes[i][b] = rec
+	}
+	return uint64(i), nil
+}
+
+// leaf returns the record for addresses that map to n's value, storing
+// it in the data section on first use.
+func (mw *mmdbWriter[V]) leaf(n *node[V], ipType int) (uint64, error) {
+	if n == nil {
+		return mmdbNone, nil
+	}
+	if rec, ok := mw.leaves[n]; ok {
+		return rec, nil
+	}
+	b, err := appendMMDB(nil, n.value, 0)
+	if err != nil {
+		return 0, fmt.Errorf("value of %v: %w", n.cidr(ipType), err)
+	}
+	off, ok := mw.offsets[string(b)]
+	if !ok {
+		off = uint64(len(mw.data))
+		mw.offsets[string(b)] = off
+		mw.data = append(mw.data, b...)
+	}
+	mw.leaves[n] = off | mmdbData
+	return off | mmdbData, nil
+}
+
+// appendMMDB appends v in the data section encoding; maps are written
+// with their keys sorted.
+func appendMMDB(b []byte, v any, depth int) ([]byte, error) {
+	if depth > mmdbMaxDepth {
+		return nil, fmt.Errorf("MMDB value nested too deep")
+	}
+	var size int
+	switch v := v.(type) {
+	case string:
+		size = len(v)
+	case []byte:
+		size = len(v)
+	case []any:
+		size = len(v)
+	case map[string]any:
+		size = len(v)
+	}
+	if size > mmdbMaxSize {
+		return nil, fmt.Errorf("MMDB cannot encode a %T of size %d", v, size)
+	}
+
+	switch v := v.(type) {
+	case string:
+		return append(appendControl(b, mmdbString, len(v)), v...), nil
+	case []byte:
+		return append(appendControl(b, mmdbBytes, len(v)), v...), nil
+	case float64:
+		return binary.BigEndian.AppendUint64(appendControl(b, mmdbDouble, 8), math.Float64bits(v)), nil
+	case float32:
+		return binary.BigEndian.AppendUint32(appendControl(b, mmdbFloat, 4), math.Float32bits(v)), nil
+	case bool:
+		if v {
+			return appendControl(b, mmdbBool, 1), nil
+		}
+		return appendControl(b, mmdbBool, 0), nil
+	case uint8:
+		return appendUint(b, mmdbUint16, uint64(v)), nil
+	case uint16:
+		return appendUint(b, mmdbUint16, uint64(v)), nil
+	case uint32:
+		return appendUint(b, mmdbUint32, uint64(v)), nil
+	case uint64:
+		return appendUint(b, mmdbUint64, v), nil
+	case uint:
+		return appendUint(b, mmdbUint64, uint64(v)), nil
+	case int8:
+		return appendInt32(b, int64(v))
+	case int16:
+		return appendInt32(b, int64(v))
+	case int32:
+		return appendInt32(b, int64(v))
+	case int64:
+		return appendInt32(b, v)
+	case int:
+		return appendInt32(b, int64(v))
+	case *big.Int:
+		if v.Sign() < 0 || v.BitLen() > 128 {
+			return nil, fmt.Errorf("MMDB cannot encode %v: out of uint128 range", v)
+		}
+		return append(appendControl(b, mmdbUint128, len(v.Bytes())), v.Bytes()...), nil
+	case []any:
+		b = appendControl(b, mmdbArray, len(v))
+		for _, e := range v {
+			var err error
+			if b, err = appendMMDB(b, e, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		b = appendControl(b, mmdbMap, len(v))
+		for _, k := range keys {
+			b = append(appendControl(b, mmdbString, len(k)), k...)
+			var err error
+			if b, err = appendMMDB(b, v[k], depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("MMDB cannot encode %T", v)
+}
+
+// appendUint appends v as an unsigned integer of the given type, in as
+// few bytes as it takes.
+func appendUint(b []byte, typ int, v uint64) []byte {
+	payload := bytes.TrimLeft(binary.BigEndian.AppendUint64(nil, v), "\x00")
+	return append(appendControl(b, typ, len(payload)), payload...)
+}
+
+// appendInt32 appends v as an int32: in 4 bytes if negative, since
+// shorter ones read as positive.
+func appendInt32(b []byte, v int64) ([]byte, error) {
+	switch {
+	case v < math.MinInt32 || v > math.MaxInt32:
+		return nil, fmt.Errorf("MMDB cannot encode %d: out of int32 range", v)
+	case v < 0:
+		return binary.BigEndian.AppendUint32(appendControl(b, mmdbInt32, 4), uint32(v)), nil
+	}
+	return appendUint(b, mmdbInt32, uint64(v)), nil
+}
+
+// appendControl appends the control byte(s) for a value of the given
+// type and size.
+func appendControl(b []byte, typ, size int) []byte {
+	c := byte(typ) << 5
+	if typ > 7 {
+		c = 0
+	}
+	var extra []byte
+	switch {
+	case size < 29:
+		c |= byte(size)
+	case size < 285:
+		c |= 29
+		extra = []byte{byte(size - 29)}
+	case size < 65821:
+		c |= 30
+		extra = binary.BigEndian.AppendUint16(nil, uint16(size-285))
+	default:
+		c |= 31
+		s := size - 65821
+		extra = []byte{byte(s >> 16), byte(s >> 8), byte(s)}
+	}
+	b = append(b, c)
+	if typ > 7 {
+		b = append(b, byte(typ-7))
+	}
+	return append(b, extra...)
+}
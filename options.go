@@ -0,0 +1,144 @@
+package pytricia
+
+import "net/netip"
+
+// KeyMode selects how a trie treats keys with host bits set past the
+// mask, such as 10.1.2.3/8.
+type KeyMode int
+
+const (
+	// Normalize masks host bits off: 10.1.2.3/8 is 10.0.0.0/8. The default.
+	Normalize KeyMode = iota
+	// RejectHostBits refuses such keys with a *PrefixError (ReasonHostBits);
+	// a lookup with one finds nothing.
+	RejectHostBits
+	// PreserveOriginalKey matches like Normalize, but remembers each key
+	// as it was last written and reports it that way (GetKey, Keys, ...).
+	PreserveOriginalKey
+)
+
+// Option configures a trie at construction.
+type Option func(*options)
+
+// options is the configuration a trie's versions share.
+type options struct {
+	keyMode     KeyMode
+	embed       [3]EmbedPolicy // by Embedding
+	codec       any            // a Codec of the trie's value type, or nil for gob
+	jsonDecoder any            // a WithJSONDecoder func, or nil for json.Unmarshal
+}
+
+// defaults is the configuration of a trie built without options.
+var defaults = &options{}
+
+// newOptions applies opts over the defaults.
+func newOptions(opts []Option) *options {
+	if len(opts) == 0 {
+		return defaults
+	}
+	o := *defaults
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &o
+}
+
+// WithKeyMode sets how keys with host bits are handled.
+func WithKeyMode(m KeyMode) Option {
+	return func(o *options) { o.keyMode = m }
+}
+
+// resolve checks p against the trie's key mode and embedded-IPv4
+// policies and returns its family and key. Every method taking a key
+// goes through here.
+func (tr *tree[V]) resolve(p netip.Prefix) (int, key, error) { return tr.cfg.resolve(p) }
+
+// resolve: tree.resolve, for whatever holds the configuration.
+func (o *options) resolve(p netip.Prefix) (int, key, error) {
+	if err := checkPrefix(p); err != nil {
+		return 0, key{}, err
+	}
+	p, err := o.unembed(p)
+	if err != nil {
+		return 0, key{}, err
+	}
+	if o.keyMode == RejectHostBits && p != p.Masked() {
+		return 0, key{}, &PrefixError{Input: p.String(), Pos: -1, Reason: ReasonHostBits}
+	}
+	return ipFamily(p.Addr()), newKey(p), nil
+}
+
+// original is the key to remember for a node written as p, or nil when
+// its normalized form will do. p must have passed resolve.
+func (tr *tree[V]) original(p netip.Prefix) *netip.Prefix {
+	if tr.cfg.keyMode != PreserveOriginalKey {
+		return nil
+	}
+	if p, _ = tr.cfg.unembed(p); p == p.Masked() {
+		return nil
+	}
+	return &p
+}
+
+// Embedding names a range of IPv6 addresses that carry an IPv4 address
+// in their last 32 bits.
+type Embedding int
+
+const (
+	Mapped Embedding = iota // IPv4-mapped, ::ffff:0:0/96
+	Compat                  // IPv4-compatible, ::/96 (bar :: and ::1)
+	NAT64                   // the NAT64 well-known prefix, 64:ff9b::/96
+)
+
+// EmbedPolicy selects how keys inside an Embedding range are treated.
+// It applies to keys of /96 or longer; shorter ones are plain IPv6.
+type EmbedPolicy int
+
+const (
+	// KeepIPv6 stores and looks them up as the IPv6 they are. The default.
+	KeepIPv6 EmbedPolicy = iota
+	// UnmapIPv4 turns them into the embedded IPv4 prefix, so that
+	// ::ffff:10.0.0.0/104 and 10.0.0.0/8 are the same key.
+	UnmapIPv4
+	// RejectEmbedded refuses them with a *PrefixError
+	// (ReasonEmbeddedIPv4); a lookup with one finds nothing.
+	RejectEmbedded
+)
+
+// WithEmbeddedIPv4 sets the policy for one Embedding range.
+func WithEmbeddedIPv4(e Embedding, policy EmbedPolicy) Option {
+	return func(o *options) { o.embed[e] = policy }
+}
+
+// unembed applies the embedded-IPv4 policies to p.
+func (o *options) unembed(p netip.Prefix) (netip.Prefix, error) {
+	if o.embed == [3]EmbedPolicy{} || !p.Addr().Is6() || p.Bits() < 96 {
+		return p, nil
+	}
+	b := p.Addr().As16()
+	var e Embedding
+	switch {
+	case [10]byte(b[:10]) != [10]byte{}:
+		if [12]byte(b[:12]) != [12]byte{0, 0x64, 0xff, 0x9b} {
+			return p, nil
+		}
+		e = NAT64
+	case b[10] == 0xff && b[11] == 0xff:
+		e = Mapped
+	case b[10] == 0 && b[11] == 0:
+		if p.Bits() == 128 && [3]byte(b[12:15]) == [3]byte{} && b[15] <= 1 {
+			return p, nil // :: and ::1 are not IPv4-compatible
+		}
+		e = Compat
+	default:
+		return p, nil
+	}
+
+	switch o.embed[e] {
+	case UnmapIPv4:
+		return netip.PrefixFrom(netip.AddrFrom4([4]byte(b[12:])), p.Bits()-96), nil
+	case RejectEmbedded:
+		return p, &PrefixError{Input: p.String(), Pos: -1, Reason: ReasonEmbeddedIPv4}
+	}
+	return p, nil
+}
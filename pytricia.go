@@ -1,56 +1,155 @@
 package pytricia
 
 import (
-	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 )
 
+// NewTrie initializes an empty trie holding values of type V.
+func NewTrie[V any](opts ...Option) *Trie[V] {
+	t := &Trie[V]{}
+	t.root.Store(newTree[V](newOptions(opts)))
+	return t
+}
+
+// Trie is a prefix trie holding IPv4 and IPv6 prefixes in two
+// independent subtrees, so the families never share nodes. Each prefix
+// maps to a value of type V; nil and zero values are stored like any
+// other, since presence is tracked separately.
+//
+// Readers never lock. Published nodes are immutable: every write copies
+// just the nodes on the path it changes, then swaps the new version in
+// with one atomic store. A lookup or traversal therefore runs against
+// whichever complete version was current when it started, while writers
+// serialize among themselves on the mutex.
+type Trie[V any] struct {
+	root  atomic.Pointer[tree[V]]
+	mutex sync.Mutex                  // held by writers only
+	subs  map[*subscriber[V]]struct{} // guarded by mutex
+}
+
 // NewPyTricia initializes pytricia object
-func NewPyTricia() *PyTricia {
-	return &PyTricia{
-		children: [2]*PyTricia{nil, nil},
-		parent:   nil,
-		value:    nil,
-		mutex:    sync.RWMutex{},
-	}
+func NewPyTricia(opts ...Option) *PyTricia {
+	t := &PyTricia{}
+	t.root.Store(newTree[any](newOptions(opts)))
+	return t
 }
 
-// PyTricia represents a node in the PyTricia trie.
+// PyTricia is the untyped trie: a Trie[any] whose lookups report a
+// missing entry as a nil value, as they always have. The typed methods
+// remain reachable through the embedded Trie field.
 type PyTricia struct {
-	ipType   int
-	children [2]*PyTricia
-	parent   *PyTricia
-	value    interface{}
-	mutex    sync.RWMutex
-}
-
-func (n *PyTricia) cidr() *net.IPNet {
-	// ─── 1. Find a node that knows the family (4 or 6). ──────────────────
-	fam := n
-	for fam != nil && fam.ipType == 0 {
-		fam = fam.parent
-	}
-	if fam == nil {
-		return nil // should never happen, but guard anyway
+	Trie[any]
+}
+
+// pyTricia wraps the untyped trie t, a fresh result nothing else holds,
+// as a PyTricia.
+func pyTricia(t *Trie[any]) *PyTricia {
+	pt := &PyTricia{}
+	pt.root.Store(t.load())
+	return pt
+}
+
+// trie returns the Trie under t, or nil for a nil t.
+func (t *PyTricia) trie() *Trie[any] {
+	if t == nil {
+		return nil
 	}
+	return &t.Trie
+}
 
-	// ─── 2. Build the full bit-path from *root* to the original node. ────
-	// We collect bits in reverse, then reverse once at the end because
-	// prepending in a loop explodes the allocator.
-	var revBits []byte
-	for cur := n; cur.parent != nil; cur = cur.parent {
-		if cur == cur.parent.children[0] {
-			revBits = append(revBits, 0)
-		} else {
-			revBits = append(revBits, 1)
+// tree is one immutable version of a Trie: a root per address family,
+// plus the configuration every version of that trie shares.
+type tree[V any] struct {
+	v4  *node[V]
+	v6  *node[V]
+	cfg *options
+}
+
+// newTree returns an empty version.
+func newTree[V any](cfg *options) *tree[V] {
+	return &tree[V]{v4: &node[V]{}, v6: &node[V]{}, cfg: cfg}
+}
+
+// node is one entry of a path-compressed (Patricia) subtree. Each node
+// stores its full prefix, so a child may sit any number of bits below
+// its parent; only prefixes that hold a value or where two branches
+// diverge get a node at all. Family roots are the zero-length prefix.
+type node[V any] struct {
+	key      key
+	children [2]*node[V]
+	value    V
+	set      bool          // value is present
+	orig     *netip.Prefix // key as written, if PreserveOriginalKey kept it
+}
+
+// load returns the current version; a zero or nil Trie reads as empty.
+func (t *Trie[V]) load() *tree[V] {
+	if t != nil {
+		if tr := t.root.Load(); tr != nil {
+			return tr
 		}
 	}
-	// Reverse into forward order.
-	bits := make([]byte, len(revBits))
-	for i := range revBits {
-		bits[len(revBits)-1-i] = revBits[i]
+	return newTree[V](defaults)
+}
+
+// root returns the subtree root for the given address family (4 or 6).
+func (tr *tree[V]) root(ipType int) *node[V] {
+	if ipType == 4 {
+		return tr.v4
+	}
+	return tr.v6
+}
+
+// set replaces one family root of a version still under construction.
+func (tr *tree[V]) set(ipType int, root *node[V]) {
+	if ipType == 4 {
+		tr.v4 = root
+	} else {
+		tr.v6 = root
+	}
+}
+
+// with returns a copy of the version with one family root replaced.
+func (tr *tree[V]) with(ipType int, root *node[V]) *tree[V] {
+	next := *tr
+	next.set(ipType, root)
+	return &next
+}
+
+// child returns the edge of n that k continues along, or nil when k is
+// n's own prefix.
+func (n *node[V]) child(k key) *node[V] {
+	if k.plen <= n.key.plen {
+		return nil
 	}
+	return n.children[k.bit(int(n.key.plen))]
+}
+
+// cidr renders the node's prefix – as originally written, when that was
+// kept; the family comes from the subtree the caller walked, never from
+// the node.
+func (n *node[V]) cidr(ipType int) netip.Prefix {
+	if n.orig != nil {
+		return *n.orig
+	}
+	return n.key.prefix(ipType)
+}
+
+// clone returns a private, mutable copy of n for a writer to modify.
+func (n *node[V]) clone() *node[V] {
+	c := *n
+	return &c
+}
+
+// store sets the node's value and marks it present.
+func (n *node[V]) store(value V) {
+	n.value, n.set = value, true
+}
 
-	// ─── 3. Convert the bit slice to *net.IPNet. ─────────────────────────
-	return binaryToCIDR(bits, fam.ipType)
+// unset drops the node's value.
+func (n *node[V]) unset() {
+	var zero V
+	n.value, n.set, n.orig = zero, false, nil
 }
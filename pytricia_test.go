@@ -1,6 +1,22 @@
 package pytricia
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -141,6 +157,2259 @@ func TestPytriciaIPv6(t *testing.T) {
 	}
 }
 
+func TestPytriciaDualStack(t *testing.T) {
+	t.Parallel()
+
+	pt := NewPyTricia()
+
+	// 10.0.0.0/8 and a00::/8 share their first eight bits, as do the two
+	// default routes; interleave them so any shared node would show up.
+	pt.Insert("10.0.0.0/8", "v4-8")
+	pt.Insert("a00::/8", "v6-8")
+	pt.Insert("10.1.0.0/16", "v4-16")
+	pt.Insert("a01::/16", "v6-16")
+	pt.Insert("0.0.0.0/0", "v4-default")
+	pt.Insert("::/0", "v6-default")
+
+	if val := pt.Get("10.1.2.3"); val != "v4-16" {
+		t.Errorf("Error on test 1: %v", val)
+	}
+	if val := pt.Get("a01::1"); val != "v6-16" {
+		t.Errorf("Error on test 2: %v", val)
+	}
+	if val := pt.Get("10.2.0.0"); val != "v4-8" {
+		t.Errorf("Error on test 3: %v", val)
+	}
+	if val := pt.Get("a02::"); val != "v6-8" {
+		t.Errorf("Error on test 4: %v", val)
+	}
+	if val := pt.Get("11.0.0.0"); val != "v4-default" {
+		t.Errorf("Error on test 5: %v", val)
+	}
+	if val := pt.Get("b00::"); val != "v6-default" {
+		t.Errorf("Error on test 6: %v", val)
+	}
+
+	if key := pt.GetKey("10.1.2.3"); key != "10.1.0.0/16" {
+		t.Errorf("Error on test 7: %v", key)
+	}
+	if key := pt.GetKey("a01::1"); key != "a01::/16" {
+		t.Errorf("Error on test 8: %v", key)
+	}
+	if key := pt.GetKey("b00::"); key != "::/0" {
+		t.Errorf("Error on test 9: %v", key)
+	}
+
+	if !pt.HasKey("a00::/8") || !pt.HasKey("10.0.0.0/8") {
+		t.Errorf("Error on test 10")
+	}
+
+	if key, val := pt.Parent("10.1.0.0/16"); key != "10.0.0.0/8" || val != "v4-8" {
+		t.Errorf("Error on test 12: %v %v", key, val)
+	}
+	if key, val := pt.Parent("a00::/8"); key != "::/0" || val != "v6-default" {
+		t.Errorf("Error on test 13: %v %v", key, val)
+	}
+
+	children := pt.Children("10.0.0.0/8")
+	if len(children) != 2 || children["10.0.0.0/8"] != "v4-8" || children["10.1.0.0/16"] != "v4-16" {
+		t.Errorf("Error on test 14: %v", children)
+	}
+	children = pt.Children("a00::/8")
+	if len(children) != 2 || children["a00::/8"] != "v6-8" || children["a01::/16"] != "v6-16" {
+		t.Errorf("Error on test 15: %v", children)
+	}
+
+	keys := pt.Keys()
+	expected := []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "::/0", "a00::/8", "a01::/16"}
+	if len(keys) != len(expected) {
+		t.Fatalf("Error on test 16: %v", keys)
+	}
+	for i := range expected {
+		if keys[i] != expected[i] {
+			t.Errorf("Error on test 16: %v", keys)
+		}
+	}
+	if m := pt.ToMap(); len(m) != 6 || m["a00::/8"] != "v6-8" || m["10.0.0.0/8"] != "v4-8" {
+		t.Errorf("Error on test 17: %v", m)
+	}
+
+	if err := pt.Delete("10.0.0.0/8"); err != nil {
+		t.Errorf("Error on test 18: %v", err)
+	}
+	if val := pt.Get("a02::"); val != "v6-8" {
+		t.Errorf("Error on test 19: %v", val)
+	}
+	if val := pt.Get("10.2.0.0"); val != "v4-default" {
+		t.Errorf("Error on test 20: %v", val)
+	}
+
+	pt.Clear()
+	if keys := pt.Keys(); len(keys) != 0 {
+		t.Errorf("Error on test 21: %v", keys)
+	}
+}
+
+func TestPytriciaCompressed(t *testing.T) {
+	t.Parallel()
+
+	rng := rand.New(rand.NewSource(1))
+	pt := NewPyTricia()
+	ref := map[string]interface{}{}
+
+	// Draw from a small address space so prefixes nest and collide a lot.
+	randomCIDR := func() string {
+		if rng.Intn(2) == 0 {
+			return fmt.Sprintf("10.%d.%d.0/%d", rng.Intn(4), rng.Intn(256), 8+rng.Intn(25))
+		}
+		return fmt.Sprintf("2001:db8:%x::/%d", rng.Intn(8), 32+rng.Intn(97))
+	}
+	normalize := func(cidr string) string {
+		_, n, _ := net.ParseCIDR(cidr)
+		return n.String()
+	}
+
+	for i := 0; i < 2000; i++ {
+		cidr := randomCIDR()
+		if rng.Intn(3) == 0 {
+			_, present := ref[normalize(cidr)]
+			if err := pt.Delete(cidr); (err == nil) != present {
+				t.Fatalf("Error on delete %v: %v", cidr, err)
+			}
+			delete(ref, normalize(cidr))
+			continue
+		}
+		pt.Insert(cidr, i)
+		ref[normalize(cidr)] = i
+	}
+
+	checkCompressed(t, pt.load().v4, true)
+	checkCompressed(t, pt.load().v6, true)
+
+	if m := pt.ToMap(); len(m) != len(ref) {
+		t.Errorf("Error on ToMap: got %d entries, want %d", len(m), len(ref))
+	}
+	for cidr, want := range ref {
+		if got := pt.Get(cidr); got != want {
+			t.Errorf("Error on Get %v: %v != %v", cidr, got, want)
+		}
+		if !pt.HasKey(cidr) {
+			t.Errorf("Error on HasKey %v", cidr)
+		}
+	}
+
+	// Longest-prefix match against a brute-force scan of the reference.
+	for i := 0; i < 2000; i++ {
+		addr := net.ParseIP(fmt.Sprintf("10.%d.%d.%d", rng.Intn(4), rng.Intn(256), rng.Intn(256)))
+		if i%2 == 1 {
+			addr = net.ParseIP(fmt.Sprintf("2001:db8:%x::%x", rng.Intn(8), rng.Intn(1<<16)))
+		}
+		wantKey, wantOnes := "", -1
+		for cidr := range ref {
+			_, n, _ := net.ParseCIDR(cidr)
+			if ones, _ := n.Mask.Size(); n.Contains(addr) && ones > wantOnes {
+				wantKey, wantOnes = cidr, ones
+			}
+		}
+		if got := pt.GetKey(addr.String()); got != wantKey {
+			t.Errorf("Error on GetKey %v: %v != %v", addr, got, wantKey)
+		}
+	}
+}
+
+// checkCompressed asserts the Patricia invariants below n: every child
+// lies strictly inside its parent on the correct side, and every node
+// other than a family root either holds a value or forks two ways.
+func checkCompressed[V any](t *testing.T, n *node[V], isRoot bool) {
+	t.Helper()
+	if !isRoot && !n.set && (n.children[0] == nil || n.children[1] == nil) {
+		t.Errorf("Error on compression: redundant node %+v", n.key)
+	}
+	for b, c := range n.children {
+		if c == nil {
+			continue
+		}
+		if c.key.plen <= n.key.plen || !n.key.contains(c.key) || c.key.bit(int(n.key.plen)) != b {
+			t.Errorf("Error on compression: %+v misplaced under %+v", c.key, n.key)
+		}
+		checkCompressed(t, c, false)
+	}
+}
+
+func TestPytriciaNetip(t *testing.T) {
+	t.Parallel()
+
+	pt := NewPyTricia()
+	p8 := netip.MustParsePrefix("10.0.0.0/8")
+	p24 := netip.MustParsePrefix("10.1.2.0/24")
+	p6 := netip.MustParsePrefix("2001:db8::/32")
+
+	if err := pt.InsertPrefix(p8, "eight"); err != nil {
+		t.Errorf("Error on test 1: %v", err)
+	}
+	if err := pt.AddPrefix(p24, "twentyfour"); err != nil {
+		t.Errorf("Error on test 2: %v", err)
+	}
+	if err := pt.AddPrefix(p24, "again"); err == nil {
+		t.Errorf("Error on test 3")
+	}
+	if err := pt.SetPrefix(p6, "missing"); err == nil {
+		t.Errorf("Error on test 4")
+	}
+	if err := pt.InsertPrefix(netip.Prefix{}, "invalid"); err == nil {
+		t.Errorf("Error on test 5")
+	}
+	pt.InsertPrefix(netip.MustParsePrefix("2001:db8:ffff::1/32"), "six") // host bits masked
+
+	key, val, ok := pt.LookupAddr(netip.MustParseAddr("10.1.2.3"))
+	if !ok || key != p24 || val != "twentyfour" {
+		t.Errorf("Error on test 6: %v %v %v", key, val, ok)
+	}
+	key, val, ok = pt.LookupAddr(netip.MustParseAddr("2001:db8::1"))
+	if !ok || key != p6 || val != "six" {
+		t.Errorf("Error on test 7: %v %v %v", key, val, ok)
+	}
+	if _, _, ok := pt.LookupAddr(netip.MustParseAddr("11.0.0.0")); ok {
+		t.Errorf("Error on test 8")
+	}
+	if val := pt.GetPrefix(netip.MustParsePrefix("10.9.0.0/16")); val != "eight" {
+		t.Errorf("Error on test 9: %v", val)
+	}
+	if !pt.HasPrefix(p8) || pt.HasPrefix(netip.MustParsePrefix("10.0.0.0/9")) {
+		t.Errorf("Error on test 10")
+	}
+	if !pt.ContainsAddr(netip.MustParseAddr("10.255.0.1")) {
+		t.Errorf("Error on test 11")
+	}
+
+	key, val, ok = pt.ParentPrefix(p24)
+	if !ok || key != p8 || val != "eight" {
+		t.Errorf("Error on test 12: %v %v %v", key, val, ok)
+	}
+	if _, _, ok := pt.ParentPrefix(p8); ok {
+		t.Errorf("Error on test 13")
+	}
+	if children := pt.ChildrenPrefix(p8); len(children) != 2 || children[p24] != "twentyfour" {
+		t.Errorf("Error on test 14: %v", children)
+	}
+
+	// The string API is a wrapper: both views must agree.
+	if pt.GetKey("10.1.2.3") != p24.String() || pt.Get("2001:db8::1") != "six" {
+		t.Errorf("Error on test 15")
+	}
+	if err := pt.DeletePrefix(p24); err != nil || pt.HasKey("10.1.2.0/24") {
+		t.Errorf("Error on test 16: %v", err)
+	}
+}
+
+// Not parallel: AllocsPerRun refuses to run alongside other tests.
+func TestLookupAddrAllocs(t *testing.T) {
+	pt := NewPyTricia()
+	pt.Insert("10.0.0.0/8", "eight")
+	pt.Insert("2001:db8::/32", "six")
+
+	for _, addr := range []netip.Addr{netip.MustParseAddr("10.1.2.3"), netip.MustParseAddr("2001:db8::1")} {
+		if allocs := testing.AllocsPerRun(100, func() { pt.LookupAddr(addr) }); allocs != 0 {
+			t.Errorf("Error on %v: LookupAddr allocates %v times", addr, allocs)
+		}
+	}
+	if allocs := testing.AllocsPerRun(100, func() { pt.Snapshot() }); allocs != 0 {
+		t.Errorf("Error on Snapshot: allocates %v times", allocs)
+	}
+}
+
+func TestTrieTyped(t *testing.T) {
+	t.Parallel()
+
+	type route struct{ nextHop string }
+	tr := NewTrie[*route]()
+
+	// A nil pointer and a zero value are real entries, not "missing".
+	tr.Insert("10.0.0.0/8", nil)
+	if val, ok := tr.Get("10.1.2.3"); !ok || val != nil {
+		t.Errorf("Error on test 1: %v %v", val, ok)
+	}
+	if !tr.HasKey("10.0.0.0/8") || !tr.Contains("10.9.9.9") {
+		t.Errorf("Error on test 2")
+	}
+	if err := tr.Add("10.0.0.0/8", &route{"x"}); err == nil {
+		t.Errorf("Error on test 3")
+	}
+	if _, ok := tr.Get("11.0.0.0"); ok {
+		t.Errorf("Error on test 4")
+	}
+
+	hop := &route{"192.0.2.1"}
+	tr.Insert("10.1.0.0/16", hop)
+	if key, val, ok := tr.GetKV("10.1.2.3"); !ok || key != "10.1.0.0/16" || val != hop {
+		t.Errorf("Error on test 5: %v %v %v", key, val, ok)
+	}
+	if key, val, ok := tr.Parent("10.1.2.3"); !ok || key != "10.0.0.0/8" || val != nil {
+		t.Errorf("Error on test 6: %v %v %v", key, val, ok)
+	}
+
+	m := tr.ToMap()
+	if len(m) != 2 || m[netip.MustParsePrefix("10.1.0.0/16")] != hop {
+		t.Errorf("Error on test 7: %v", m)
+	}
+	if val, ok := m[netip.MustParsePrefix("10.0.0.0/8")]; !ok || val != nil {
+		t.Errorf("Error on test 8: %v", m)
+	}
+
+	if err := tr.Delete("10.0.0.0/8"); err != nil || tr.HasKey("10.0.0.0/8") {
+		t.Errorf("Error on test 9: %v", err)
+	}
+	if err := tr.Set("10.0.0.0/8", hop); err == nil {
+		t.Errorf("Error on test 10")
+	}
+
+	counts := NewTrie[int]()
+	counts.Insert("::/0", 0)
+	if val, ok := counts.Get("2001:db8::1"); !ok || val != 0 {
+		t.Errorf("Error on test 11: %v %v", val, ok)
+	}
+
+	// The compatibility wrapper still speaks interface{} and nil.
+	pt := NewPyTricia()
+	pt.Insert("8.8.8.0/24", nil)
+	if !pt.HasKey("8.8.8.0/24") || pt.Get("8.8.8.8") != nil {
+		t.Errorf("Error on test 12")
+	}
+	if val, ok := pt.Trie.Get("8.8.8.8"); !ok || val != nil {
+		t.Errorf("Error on test 13: %v %v", val, ok)
+	}
+}
+
+func TestTrieIterators(t *testing.T) {
+	t.Parallel()
+
+	tr := NewTrie[string]()
+	for _, cidr := range []string{
+		"2001:db8::/32", "10.1.0.0/16", "10.0.0.0/8", "10.1.2.0/24",
+		"10.1.3.0/24", "0.0.0.0/0", "2001:db8:1::/48", "192.168.0.0/16",
+	} {
+		tr.Insert(cidr, cidr)
+	}
+
+	collect := func(seq func(func(netip.Prefix, string) bool)) []string {
+		out := []string{}
+		for p, v := range seq {
+			if p.String() != v {
+				t.Errorf("Error on value for %v: %v", p, v)
+			}
+			out = append(out, v)
+		}
+		return out
+	}
+	same := func(test int, got []string, want ...string) {
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Error on test %d: %v", test, got)
+		}
+	}
+
+	same(1, collect(tr.All()), "0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24",
+		"10.1.3.0/24", "192.168.0.0/16", "2001:db8::/32", "2001:db8:1::/48")
+	same(2, collect(tr.Descendants(netip.MustParsePrefix("10.1.0.0/16"))),
+		"10.1.0.0/16", "10.1.2.0/24", "10.1.3.0/24")
+	// Nothing is stored at 10.1.2.0/23, yet both /24s lie inside it.
+	same(3, collect(tr.Descendants(netip.MustParsePrefix("10.1.2.0/23"))),
+		"10.1.2.0/24", "10.1.3.0/24")
+	same(4, collect(tr.Descendants(netip.MustParsePrefix("172.16.0.0/12"))))
+	same(5, collect(tr.Ancestors(netip.MustParsePrefix("10.1.2.128/25"))),
+		"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24")
+	same(6, collect(tr.Ancestors(netip.MustParsePrefix("2001:db8:1:2::1/128"))),
+		"2001:db8::/32", "2001:db8:1::/48")
+
+	// Early termination stops the walk and releases the read-lock.
+	count := 0
+	for range tr.All() {
+		if count++; count == 3 {
+			break
+		}
+	}
+	if count != 3 {
+		t.Errorf("Error on test 7: %v", count)
+	}
+	tr.Insert("10.2.0.0/16", "10.2.0.0/16")
+
+	prefixes := []netip.Prefix{}
+	for p := range tr.Prefixes() {
+		prefixes = append(prefixes, p)
+	}
+	if len(prefixes) != 9 || prefixes[5] != netip.MustParsePrefix("10.2.0.0/16") {
+		t.Errorf("Error on test 8: %v", prefixes)
+	}
+	// A nil PyTricia reads as empty, as it always has.
+	var nilPT *PyTricia
+	if len(nilPT.Keys()) != 0 || len(nilPT.Values()) != 0 || len(nilPT.Items()) != 0 || len(nilPT.ToMap()) != 0 {
+		t.Errorf("Error on test 9")
+	}
+}
+
+func TestTrieOrderedOutput(t *testing.T) {
+	t.Parallel()
+
+	tr := NewTrie[int]()
+	inserted := []string{"10.1.3.0/24", "2001:db8::/32", "10.1.0.0/16", "::/0", "10.1.2.0/24", "10.1.0.0/24", "9.0.0.0/8"}
+	for i, cidr := range inserted {
+		tr.Insert(cidr, i)
+	}
+	want := []string{"9.0.0.0/8", "10.1.0.0/16", "10.1.0.0/24", "10.1.2.0/24", "10.1.3.0/24", "::/0", "2001:db8::/32"}
+
+	if keys := tr.Keys(); fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("Error on test 1: %v", keys)
+	}
+	items := tr.Items()
+	values := tr.Values()
+	if len(items) != len(want) || len(values) != len(want) {
+		t.Fatalf("Error on test 2: %v %v", items, values)
+	}
+	for i, item := range items {
+		if item.Prefix.String() != want[i] || inserted[item.Value] != want[i] || values[i] != item.Value {
+			t.Errorf("Error on test 3: %v", items)
+		}
+	}
+
+	children := tr.ChildrenSorted("10.1.0.0/16")
+	if len(children) != 4 || children[0].Prefix.String() != "10.1.0.0/16" || children[1].Prefix.String() != "10.1.0.0/24" ||
+		children[2].Prefix.String() != "10.1.2.0/24" || children[3].Prefix.String() != "10.1.3.0/24" {
+		t.Errorf("Error on test 4: %v", children)
+	}
+	if children := tr.ChildrenPrefixSorted(netip.MustParsePrefix("::/0")); len(children) != 2 ||
+		children[0].Prefix.String() != "::/0" || children[1].Prefix.String() != "2001:db8::/32" {
+		t.Errorf("Error on test 5: %v", children)
+	}
+	if children := tr.ChildrenSorted("172.16.0.0/12"); len(children) != 0 {
+		t.Errorf("Error on test 6: %v", children)
+	}
+
+	// The same contents inserted in another order give identical output.
+	other := NewTrie[int]()
+	for i := len(inserted) - 1; i >= 0; i-- {
+		other.Insert(inserted[i], i)
+	}
+	if fmt.Sprint(other.Items()) != fmt.Sprint(items) {
+		t.Errorf("Error on test 7: %v", other.Items())
+	}
+}
+
+func TestTrieCovering(t *testing.T) {
+	t.Parallel()
+
+	pt := NewPyTricia()
+	pt.Insert("0.0.0.0/0", "default")
+	pt.Insert("10.0.0.0/8", "eight")
+	pt.Insert("10.1.0.0/16", "sixteen")
+	pt.Insert("10.1.2.0/24", "twentyfour")
+	pt.Insert("10.1.3.0/24", "other")
+	pt.Insert("::/0", "v6-default")
+
+	chain := pt.GetAll("10.1.2.3")
+	want := []string{"10.1.2.0/24", "10.1.0.0/16", "10.0.0.0/8", "0.0.0.0/0"}
+	values := []string{"twentyfour", "sixteen", "eight", "default"}
+	if len(chain) != len(want) {
+		t.Fatalf("Error on test 1: %v", chain)
+	}
+	for i, item := range chain {
+		if item.Prefix.String() != want[i] || item.Value != values[i] {
+			t.Errorf("Error on test 2: %v", chain)
+		}
+	}
+
+	// Same answer as asking Parent over and over.
+	key := pt.GetKey("10.1.2.3")
+	for i := 1; i < len(want); i++ {
+		key, _ = pt.Parent(key)
+		if key != want[i] {
+			t.Errorf("Error on test 3: %v", key)
+		}
+	}
+
+	if chain := pt.Covering(netip.MustParsePrefix("10.1.0.0/16")); len(chain) != 3 || chain[0].Value != "sixteen" {
+		t.Errorf("Error on test 4: %v", chain)
+	}
+	if chain := pt.GetAll("2001:db8::1"); len(chain) != 1 || chain[0].Value != "v6-default" {
+		t.Errorf("Error on test 5: %v", chain)
+	}
+	if chain := pt.GetAll("not an ip"); len(chain) != 0 {
+		t.Errorf("Error on test 6: %v", chain)
+	}
+}
+
+func TestTrieCoveredBy(t *testing.T) {
+	t.Parallel()
+
+	keys := func(items []Item[string]) string {
+		out := []string{}
+		for _, item := range items {
+			out = append(out, item.Prefix.String())
+		}
+		return fmt.Sprint(out)
+	}
+	p16 := netip.MustParsePrefix("10.1.0.0/16")
+
+	// Nothing stored at or above the query.
+	tr := NewTrie[string]()
+	tr.Insert("10.1.2.0/24", "a")
+	tr.Insert("10.1.3.0/24", "b")
+	tr.Insert("10.2.0.0/24", "outside")
+	if got := keys(tr.CoveredBy(p16, true)); got != "[10.1.2.0/24 10.1.3.0/24]" {
+		t.Errorf("Error on test 1: %v", got)
+	}
+	if got := keys(tr.CoveredBy(p16, false)); got != "[10.1.2.0/24 10.1.3.0/24]" {
+		t.Errorf("Error on test 2: %v", got)
+	}
+	if got := tr.Children("10.1.0.0/16"); len(got) != 0 {
+		t.Errorf("Error on test 3: %v", got)
+	}
+
+	// A covering /8 is stored: it, and its other children, stay out.
+	tr.Insert("10.0.0.0/8", "eight")
+	if got := keys(tr.CoveredBy(p16, true)); got != "[10.1.2.0/24 10.1.3.0/24]" {
+		t.Errorf("Error on test 4: %v", got)
+	}
+
+	// The query prefix itself is stored: the flag decides.
+	tr.Insert("10.1.0.0/16", "sixteen")
+	if got := keys(tr.CoveredBy(p16, true)); got != "[10.1.0.0/16 10.1.2.0/24 10.1.3.0/24]" {
+		t.Errorf("Error on test 5: %v", got)
+	}
+	if got := keys(tr.CoveredBy(p16, false)); got != "[10.1.2.0/24 10.1.3.0/24]" {
+		t.Errorf("Error on test 6: %v", got)
+	}
+	if got := keys(tr.CoveredBy(netip.MustParsePrefix("10.1.2.0/24"), false)); got != "[]" {
+		t.Errorf("Error on test 7: %v", got)
+	}
+	if got := keys(tr.CoveredBy(netip.MustParsePrefix("0.0.0.0/0"), false)); got != "[10.0.0.0/8 10.1.0.0/16 10.1.2.0/24 10.1.3.0/24 10.2.0.0/24]" {
+		t.Errorf("Error on test 8: %v", got)
+	}
+	if got := keys(tr.CoveredBy(netip.MustParsePrefix("::/0"), true)); got != "[]" {
+		t.Errorf("Error on test 9: %v", got)
+	}
+}
+
+func TestTrieIteratorOrder(t *testing.T) {
+	t.Parallel()
+
+	tr := NewTrie[int]()
+	for i := 0; i < 2000; i++ {
+		if i%2 == 0 {
+			tr.Insert(randomIPv4CIDR(), i)
+		} else {
+			tr.Insert(randomIPv6CIDR(), i)
+		}
+	}
+
+	var prev netip.Prefix
+	for p := range tr.Prefixes() {
+		if prev.IsValid() && !prefixLess(prev, p) {
+			t.Errorf("Error on order: %v before %v", prev, p)
+		}
+		prev = p
+	}
+}
+
+// prefixLess orders IPv4 before IPv6, then by address, then by length.
+func prefixLess(a, b netip.Prefix) bool {
+	if a.Addr().Is4() != b.Addr().Is4() {
+		return a.Addr().Is4()
+	}
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c < 0
+	}
+	return a.Bits() < b.Bits()
+}
+
+func TestTrieConcurrent(t *testing.T) {
+	t.Parallel()
+
+	tr := NewTrie[int]()
+	for i := 0; i < 256; i++ {
+		tr.Insert(fmt.Sprintf("10.%d.0.0/16", i), i)
+	}
+
+	var writers, readers sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Writers churn inserts and deletes across nested prefixes.
+	for w := 0; w < 2; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < 3000; i++ {
+				cidr := fmt.Sprintf("10.%d.%d.0/%d", rng.Intn(256), rng.Intn(256), 16+rng.Intn(9))
+				if rng.Intn(2) == 0 {
+					tr.Insert(cidr, i)
+				} else {
+					tr.Delete(cidr)
+				}
+			}
+		}(w)
+	}
+
+	// Readers traverse and look up without any locking of their own.
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				var prev netip.Prefix
+				for p := range tr.All() {
+					if prev.IsValid() && !prefixLess(prev, p) {
+						t.Errorf("Error on order: %v before %v", prev, p)
+					}
+					prev = p
+				}
+				tr.Children("10.1.0.0/16")
+				tr.Covering(netip.MustParsePrefix("10.1.2.3/32"))
+				tr.CoveredBy(netip.MustParsePrefix("10.0.0.0/8"), false)
+				tr.LookupAddr(netip.MustParseAddr("10.1.2.3"))
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+}
+
+func TestTrieCopyOnWrite(t *testing.T) {
+	t.Parallel()
+
+	tr := NewTrie[string]()
+	tr.Insert("10.0.0.0/8", "eight")
+	tr.Insert("10.1.0.0/16", "sixteen")
+	tr.Insert("10.1.2.0/24", "twentyfour")
+
+	old := tr.load()
+	before := fmt.Sprint(old.Items())
+
+	tr.Insert("10.1.3.0/24", "new")
+	tr.Set("10.0.0.0/8", "changed")
+	tr.Delete("10.1.0.0/16")
+	tr.Delete("10.1.2.0/24")
+
+	// The earlier version is untouched by any of the writes.
+	if after := fmt.Sprint(old.Items()); after != before {
+		t.Errorf("Error on test 1: %v != %v", after, before)
+	}
+	if got := fmt.Sprint(tr.Keys()); got != "[10.0.0.0/8 10.1.3.0/24]" {
+		t.Errorf("Error on test 2: %v", got)
+	}
+
+	// The loop body may write to the trie it is iterating.
+	for p := range tr.All() {
+		tr.Delete(p.String())
+	}
+	if keys := tr.Keys(); len(keys) != 0 {
+		t.Errorf("Error on test 3: %v", keys)
+	}
+
+	var zero Trie[int]
+	if _, ok := zero.Get("10.0.0.0"); ok {
+		t.Errorf("Error on test 4")
+	}
+	zero.Insert("10.0.0.0/8", 8)
+	if val, ok := zero.Get("10.0.0.0"); !ok || val != 8 {
+		t.Errorf("Error on test 5: %v %v", val, ok)
+	}
+}
+
+func TestTrieSnapshot(t *testing.T) {
+	t.Parallel()
+
+	tr := NewTrie[int]()
+	for i := 0; i < 512; i++ {
+		tr.Insert(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256), i)
+	}
+	snap := tr.Snapshot()
+	want := fmt.Sprint(snap.Items())
+
+	// Keep the live trie busy while the snapshot is read repeatedly.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			tr.Delete(fmt.Sprintf("10.%d.%d.0/24", (i/256)%2, i%256))
+			tr.Insert(fmt.Sprintf("10.%d.%d.0/25", i/256%2, i%256), -i)
+		}
+		tr.Clear()
+	}()
+	for i := 0; i < 20; i++ {
+		count := 0
+		for p, v := range snap.All() {
+			if p.String() != fmt.Sprintf("10.%d.%d.0/24", v/256, v%256) {
+				t.Errorf("Error on test 1: %v %v", p, v)
+			}
+			count++
+		}
+		if count != 512 {
+			t.Errorf("Error on test 2: %v", count)
+		}
+	}
+	<-done
+
+	if got := fmt.Sprint(snap.Items()); got != want {
+		t.Errorf("Error on test 3")
+	}
+	if val, ok := snap.Get("10.1.255.1"); !ok || val != 511 {
+		t.Errorf("Error on test 4: %v %v", val, ok)
+	}
+	if key, _, ok := snap.LookupAddr(netip.MustParseAddr("10.0.7.7")); !ok || key.String() != "10.0.7.0/24" {
+		t.Errorf("Error on test 5: %v %v", key, ok)
+	}
+	if items := snap.CoveredBy(netip.MustParsePrefix("10.0.0.0/23"), true); len(items) != 2 {
+		t.Errorf("Error on test 6: %v", items)
+	}
+	if keys := tr.Keys(); len(keys) != 0 {
+		t.Errorf("Error on test 7: %v", keys)
+	}
+
+	// A fresh snapshot sees the current state.
+	tr.Insert("192.0.2.0/24", 1)
+	if got := tr.Snapshot().Keys(); fmt.Sprint(got) != "[192.0.2.0/24]" {
+		t.Errorf("Error on test 8: %v", got)
+	}
+	// The zero Snapshot reads as an empty trie.
+	var zero Snapshot[int]
+	if _, ok := zero.Get("10.0.0.0/8"); ok || len(zero.Keys()) != 0 || zero.ContainsAddr(netip.MustParseAddr("10.0.0.1")) {
+		t.Errorf("Error on test 9")
+	}
+	if items := zero.CoveredBy(netip.MustParsePrefix("0.0.0.0/0"), true); len(items) != 0 {
+		t.Errorf("Error on test 10: %v", items)
+	}
+}
+
+func TestTrieTxn(t *testing.T) {
+	t.Parallel()
+
+	tr := NewTrie[string]()
+	tr.Insert("10.0.0.0/8", "eight")
+	tr.Insert("10.1.0.0/16", "sixteen")
+
+	// Staged writes stay invisible until Commit, then land together.
+	txn := tr.Begin()
+	if err := txn.Delete("10.1.0.0/16"); err != nil {
+		t.Errorf("Error on test 1: %v", err)
+	}
+	if err := txn.Add("10.2.0.0/16", "new"); err != nil {
+		t.Errorf("Error on test 2: %v", err)
+	}
+	if err := txn.Set("10.0.0.0/8", "changed"); err != nil {
+		t.Errorf("Error on test 3: %v", err)
+	}
+	if got := fmt.Sprint(tr.Items()); got != "[{10.0.0.0/8 eight} {10.1.0.0/16 sixteen}]" {
+		t.Errorf("Error on test 4: %v", got)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Errorf("Error on test 5: %v", err)
+	}
+	if got := fmt.Sprint(tr.Items()); got != "[{10.0.0.0/8 changed} {10.2.0.0/16 new}]" {
+		t.Errorf("Error on test 6: %v", got)
+	}
+	if err := txn.Insert("10.3.0.0/16", "late"); err == nil {
+		t.Errorf("Error on test 7")
+	}
+	if err := txn.Commit(); err == nil {
+		t.Errorf("Error on test 8")
+	}
+
+	// Conflicts against the staged view are reported straight away.
+	txn = tr.Begin()
+	if err := txn.Add("10.2.0.0/16", "dup"); err == nil {
+		t.Errorf("Error on test 9")
+	}
+	txn.Delete("10.2.0.0/16")
+	if err := txn.Set("10.2.0.0/16", "gone"); err == nil {
+		t.Errorf("Error on test 10")
+	}
+	if err := txn.Add("10.2.0.0/16", "back"); err != nil {
+		t.Errorf("Error on test 11: %v", err)
+	}
+	txn.Rollback()
+	if val, _ := tr.Get("10.2.0.0/16"); val != "new" {
+		t.Errorf("Error on test 12: %v", val)
+	}
+
+	// Unrelated writes made after Begin survive the commit.
+	txn = tr.Begin()
+	txn.Insert("192.0.2.0/24", "batch")
+	tr.Insert("198.51.100.0/24", "outside")
+	if err := txn.Commit(); err != nil {
+		t.Errorf("Error on test 13: %v", err)
+	}
+	if !tr.HasKey("192.0.2.0/24") || !tr.HasKey("198.51.100.0/24") {
+		t.Errorf("Error on test 14: %v", tr.Keys())
+	}
+
+	// A write made after Begin that breaks a staged Add aborts the batch.
+	txn = tr.Begin()
+	txn.Insert("203.0.113.0/24", "batch")
+	txn.Add("2001:db8::/32", "batch")
+	tr.Add("2001:db8::/32", "winner")
+	if err := txn.Commit(); err == nil {
+		t.Errorf("Error on test 15")
+	}
+	if tr.HasKey("203.0.113.0/24") {
+		t.Errorf("Error on test 16")
+	}
+	if val, _ := tr.Get("2001:db8::/32"); val != "winner" {
+		t.Errorf("Error on test 17: %v", val)
+	}
+
+	// Readers never observe a batch half-applied: the token always sits
+	// in exactly one of the two prefixes.
+	tr.Clear()
+	tr.Insert("10.0.0.0/24", "token")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		from, to := "10.0.0.0/24", "10.0.1.0/24"
+		for i := 0; i < 500; i++ {
+			txn := tr.Begin()
+			txn.Delete(from)
+			txn.Add(to, "token")
+			if err := txn.Commit(); err != nil {
+				t.Errorf("Error on test 18: %v", err)
+			}
+			from, to = to, from
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		snap := tr.Snapshot()
+		if snap.HasKey("10.0.0.0/24") == snap.HasKey("10.0.1.0/24") {
+			t.Fatalf("Error on test 19: %v", snap.Keys())
+		}
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	t.Parallel()
+
+	// Whatever Insert builds, BulkLoad rebuilds from its sorted items.
+	ref := NewTrie[int]()
+	ref.Insert("0.0.0.0/0", -1)
+	ref.Insert("::/0", -2)
+	for i := 0; i < 3000; i++ {
+		if i%2 == 0 {
+			ref.Insert(randomIPv4CIDR(), i)
+		} else {
+			ref.Insert(randomIPv6CIDR(), i)
+		}
+	}
+	items := ref.Items()
+	tr, err := BulkLoad(items)
+	if err != nil {
+		t.Fatalf("Error on test 1: %v", err)
+	}
+	if fmt.Sprint(tr.Items()) != fmt.Sprint(items) {
+		t.Errorf("Error on test 2")
+	}
+	checkCompressed(t, tr.load().v4, true)
+	checkCompressed(t, tr.load().v6, true)
+	for _, item := range items[:100] {
+		key, val, _ := tr.LookupAddr(item.Prefix.Addr())
+		if refKey, refVal, _ := ref.LookupAddr(item.Prefix.Addr()); key != refKey || val != refVal {
+			t.Errorf("Error on test 3: %v", item)
+		}
+	}
+
+	// The result is an ordinary trie that takes further writes.
+	if err := tr.Insert("192.0.2.0/24", 42); err != nil || !tr.HasKey("192.0.2.0/24") {
+		t.Errorf("Error on test 4: %v", err)
+	}
+
+	load := func(cidrs ...string) error {
+		items := []Item[int]{}
+		for i, cidr := range cidrs {
+			items = append(items, Item[int]{Prefix: netip.MustParsePrefix(cidr), Value: i})
+		}
+		_, err := BulkLoad(items)
+		return err
+	}
+	if err := load("10.0.0.0/8", "10.0.0.0/16", "10.1.0.0/16", "::/0"); err != nil {
+		t.Errorf("Error on test 5: %v", err)
+	}
+	if err := load("10.0.0.0/8", "10.1.2.3/8"); err == nil {
+		t.Errorf("Error on test 6: duplicate accepted")
+	}
+	if err := load("10.0.0.0/16", "10.0.0.0/8"); err == nil {
+		t.Errorf("Error on test 7: longer before shorter accepted")
+	}
+	if err := load("10.1.0.0/16", "10.0.0.0/16"); err == nil {
+		t.Errorf("Error on test 8: descending addresses accepted")
+	}
+	if err := load("::/0", "10.0.0.0/8"); err == nil {
+		t.Errorf("Error on test 9: IPv6 before IPv4 accepted")
+	}
+	if tr, err := BulkLoad([]Item[int]{}); err != nil || len(tr.Keys()) != 0 {
+		t.Errorf("Error on test 10: %v", err)
+	}
+}
+
+func TestTrieSubscribe(t *testing.T) {
+	t.Parallel()
+
+	tr := NewTrie[string]()
+	all, cancelAll := tr.Subscribe(netip.Prefix{})
+	scoped, cancelScoped := tr.Subscribe(netip.MustParsePrefix("10.1.0.0/16"))
+	defer cancelAll()
+
+	tr.Insert("10.1.2.0/24", "a")
+	tr.Insert("10.1.2.0/24", "b")
+	tr.Add("192.0.2.0/24", "outside")
+	tr.Set("10.1.2.0/24", "c")
+	tr.Delete("10.1.2.0/24")
+	tr.Insert("10.0.0.0/8", "covering, not inside")
+	tr.Delete("10.9.9.9") // fails: no event
+	tr.Clear()
+
+	next := func(ch <-chan Event[string]) Event[string] {
+		select {
+		case ev := <-ch:
+			return ev
+		default:
+			return Event[string]{}
+		}
+	}
+	expect := func(test int, ev Event[string], kind EventKind, prefix, value, old string) {
+		if ev.Kind != kind || (ev.Kind != Cleared && ev.Prefix.String() != prefix) || ev.Value != value || ev.Old != old || ev.Dropped != 0 {
+			t.Errorf("Error on test %d: %+v", test, ev)
+		}
+	}
+
+	expect(1, next(scoped), Added, "10.1.2.0/24", "a", "")
+	expect(2, next(scoped), Replaced, "10.1.2.0/24", "b", "a")
+	expect(3, next(scoped), Replaced, "10.1.2.0/24", "c", "b")
+	expect(4, next(scoped), Deleted, "10.1.2.0/24", "c", "")
+	expect(5, next(scoped), Cleared, "", "", "")
+	if ev := next(scoped); ev.Kind != 0 {
+		t.Errorf("Error on test 6: %+v", ev)
+	}
+
+	kinds := []EventKind{}
+	for ev := next(all); ev.Kind != 0; ev = next(all) {
+		kinds = append(kinds, ev.Kind)
+	}
+	if fmt.Sprint(kinds) != "[Added Replaced Added Replaced Deleted Added Cleared]" {
+		t.Errorf("Error on test 7: %v", kinds)
+	}
+
+	// Cancel closes the channel once; later writes are not delivered.
+	cancelScoped()
+	cancelScoped()
+	if _, open := <-scoped; open {
+		t.Errorf("Error on test 8")
+	}
+	tr.Insert("10.1.0.0/16", "after cancel")
+	expect(9, next(all), Added, "10.1.0.0/16", "after cancel", "")
+
+	// A transaction's events arrive once it commits, in order.
+	txn := tr.Begin()
+	txn.Insert("10.2.0.0/16", "x")
+	txn.Delete("10.1.0.0/16")
+	if ev := next(all); ev.Kind != 0 {
+		t.Errorf("Error on test 10: %+v", ev)
+	}
+	txn.Commit()
+	expect(11, next(all), Added, "10.2.0.0/16", "x", "")
+	expect(12, next(all), Deleted, "10.1.0.0/16", "after cancel", "")
+
+	// A full buffer drops events instead of blocking the writer, and the
+	// next delivered event says how many were lost.
+	slow, cancelSlow := tr.Subscribe(netip.MustParsePrefix("2001:db8::/32"))
+	defer cancelSlow()
+	for i := 0; i < subscriberBuffer+10; i++ {
+		tr.Insert(fmt.Sprintf("2001:db8:%x::/48", i), "flood")
+	}
+	for i := 0; i < subscriberBuffer; i++ {
+		<-slow
+	}
+	tr.Insert("2001:db8::/32", "after flood")
+	if ev := <-slow; ev.Dropped != 10 || ev.Value != "after flood" {
+		t.Errorf("Error on test 13: %+v", ev)
+	}
+	// The filter is a key: the trie's key mode applies to it.
+	strict := NewTrie[string](WithKeyMode(RejectHostBits))
+	refused, cancelRefused := strict.Subscribe(netip.MustParsePrefix("10.1.2.3/8"))
+	defer cancelRefused()
+	strict.Insert("10.1.0.0/16", "x")
+	if _, open := <-refused; open {
+		t.Errorf("Error on test 14")
+	}
+	// So do the embedded-IPv4 policies.
+	unmapped := NewTrie[string](WithEmbeddedIPv4(Mapped, UnmapIPv4), WithEmbeddedIPv4(NAT64, RejectEmbedded))
+	mapped, cancelMapped := unmapped.Subscribe(netip.MustParsePrefix("::ffff:10.0.0.0/104"))
+	defer cancelMapped()
+	unmapped.Insert("::ffff:10.1.0.0/112", "x")
+	unmapped.Insert("192.0.2.0/24", "outside")
+	expect(15, next(mapped), Added, "10.1.0.0/16", "x", "")
+	if ev := next(mapped); ev.Kind != 0 {
+		t.Errorf("Error on test 16: %+v", ev)
+	}
+	nat64, cancelNAT64 := unmapped.Subscribe(netip.MustParsePrefix("64:ff9b::/96"))
+	defer cancelNAT64()
+	if _, open := <-nat64; open {
+		t.Errorf("Error on test 17")
+	}
+}
+
+func TestTrieErrors(t *testing.T) {
+	t.Parallel()
+
+	tr := NewTrie[int]()
+	tr.Insert("10.0.0.0/8", 1)
+
+	if err := tr.Add("10.0.0.0/8", 2); !errors.Is(err, ErrExists) {
+		t.Errorf("Error on test 1: %v", err)
+	}
+	if err := tr.Set("10.1.0.0/16", 2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Error on test 2: %v", err)
+	}
+	if err := tr.Delete("10.1.0.0/16"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Error on test 3: %v", err)
+	}
+
+	cases := []struct {
+		input  string
+		pos    int
+		reason Reason
+	}{
+		{"10.0.0.256/8", 0, ReasonBadAddress},
+		{"nonsense", 0, ReasonBadAddress},
+		{"10.0.0.0/", 9, ReasonBadMask},
+		{"10.0.0.0/2x", 10, ReasonBadMask},
+		{"10.0.0.0/33", 9, ReasonBadMask},
+		{"10.0.0.0/1234", 9, ReasonBadMask},
+		{"2001:db8::/129", 11, ReasonBadMask},
+		{"10.0.0.0/+8", 9, ReasonBadMask},
+	}
+	for i, c := range cases {
+		err := tr.Insert(c.input, 0)
+		var perr *PrefixError
+		if !errors.Is(err, ErrInvalidPrefix) || !errors.As(err, &perr) {
+			t.Errorf("Error on test %d: %v", 4+i, err)
+			continue
+		}
+		if perr.Input != c.input || perr.Pos != c.pos || perr.Reason != c.reason {
+			t.Errorf("Error on test %d: %+v", 4+i, perr)
+		}
+	}
+
+	var perr *PrefixError
+	if err := tr.InsertPrefix(netip.Prefix{}, 0); !errors.As(err, &perr) || perr.Pos != -1 || perr.Reason != ReasonBadAddress {
+		t.Errorf("Error on test 12: %v", err)
+	}
+
+	if _, err := BulkLoad([]Item[int]{{netip.MustParsePrefix("10.0.0.0/8"), 1}, {netip.MustParsePrefix("10.0.0.0/8"), 2}}); !errors.Is(err, ErrExists) {
+		t.Errorf("Error on test 13: %v", err)
+	}
+	if _, err := BulkLoad([]Item[int]{{netip.MustParsePrefix("10.1.0.0/16"), 1}, {netip.MustParsePrefix("10.0.0.0/8"), 2}}); !errors.Is(err, ErrUnsorted) {
+		t.Errorf("Error on test 14: %v", err)
+	}
+
+	txn := tr.Begin()
+	txn.Rollback()
+	if err := txn.Commit(); !errors.Is(err, ErrTxnDone) {
+		t.Errorf("Error on test 15: %v", err)
+	}
+}
+
+func TestTrieKeyModes(t *testing.T) {
+	t.Parallel()
+
+	// Normalize (the default) masks host bits off.
+	norm := NewTrie[string]()
+	if err := norm.Insert("10.1.2.3/8", "a"); err != nil || norm.GetKey("10.9.9.9") != "10.0.0.0/8" {
+		t.Errorf("Error on test 1: %v", err)
+	}
+
+	// RejectHostBits refuses such keys everywhere, writes and reads alike.
+	strict := NewTrie[string](WithKeyMode(RejectHostBits))
+	err := strict.Insert("10.1.2.3/8", "a")
+	var perr *PrefixError
+	if !errors.Is(err, ErrInvalidPrefix) || !errors.As(err, &perr) || perr.Reason != ReasonHostBits {
+		t.Errorf("Error on test 2: %v", err)
+	}
+	if err := strict.InsertPrefix(netip.MustParsePrefix("2001:db8::1/32"), "a"); !errors.Is(err, ErrInvalidPrefix) {
+		t.Errorf("Error on test 3: %v", err)
+	}
+	strict.Insert("10.0.0.0/8", "b")
+	if _, ok := strict.Get("10.1.2.3/8"); ok || strict.HasKey("10.0.0.1/8") || strict.Contains("10.1.2.3/8") {
+		t.Errorf("Error on test 4")
+	}
+	if v, ok := strict.Get("10.1.2.3"); !ok || v != "b" {
+		t.Errorf("Error on test 5: %v %v", v, ok)
+	}
+	if err := strict.Delete("10.0.0.1/8"); !errors.Is(err, ErrInvalidPrefix) || !strict.HasKey("10.0.0.0/8") {
+		t.Errorf("Error on test 6: %v", err)
+	}
+	if len(strict.CoveredBy(netip.MustParsePrefix("10.0.0.1/8"), true)) != 0 || len(strict.Children("10.0.0.1/8")) != 0 {
+		t.Errorf("Error on test 7")
+	}
+	if _, err := BulkLoad([]Item[string]{{netip.MustParsePrefix("10.0.0.1/8"), "a"}}, WithKeyMode(RejectHostBits)); !errors.Is(err, ErrInvalidPrefix) {
+		t.Errorf("Error on test 8: %v", err)
+	}
+
+	// PreserveOriginalKey matches like Normalize but reports keys as written.
+	keep := NewTrie[string](WithKeyMode(PreserveOriginalKey))
+	events, cancel := keep.Subscribe(netip.Prefix{})
+	defer cancel()
+	keep.Insert("10.1.2.3/8", "a")
+	keep.Insert("192.0.2.0/24", "b")
+	if keep.GetKey("10.9.9.9") != "10.1.2.3/8" || !keep.HasKey("10.0.0.0/8") {
+		t.Errorf("Error on test 9: %v", keep.GetKey("10.9.9.9"))
+	}
+	if fmt.Sprint(keep.Keys()) != "[10.1.2.3/8 192.0.2.0/24]" {
+		t.Errorf("Error on test 10: %v", keep.Keys())
+	}
+	if ev := <-events; ev.Prefix.String() != "10.1.2.3/8" {
+		t.Errorf("Error on test 11: %+v", ev)
+	}
+	keep.Insert("10.0.0.0/8", "c") // the latest spelling wins
+	if key, val, ok := keep.GetKV("10.1.1.1"); key != "10.0.0.0/8" || val != "c" || !ok {
+		t.Errorf("Error on test 12: %v %v %v", key, val, ok)
+	}
+	keep.Insert("10.7.7.7/8", "d")
+	if err := keep.Delete("10.0.0.0/8"); err != nil || len(keep.Keys()) != 1 {
+		t.Errorf("Error on test 13: %v", err)
+	}
+	pt := NewPyTricia(WithKeyMode(PreserveOriginalKey))
+	pt.Insert("2001:db8::1/32", 1)
+	if pt.GetKey("2001:db8:1::") != "2001:db8::1/32" {
+		t.Errorf("Error on test 14: %v", pt.GetKey("2001:db8:1::"))
+	}
+	bulk, err := BulkLoad([]Item[int]{{netip.MustParsePrefix("10.0.0.1/8"), 1}}, WithKeyMode(PreserveOriginalKey))
+	if err != nil || bulk.GetKey("10.0.0.0/8") != "10.0.0.1/8" {
+		t.Errorf("Error on test 15: %v", err)
+	}
+}
+
+func TestTrieEmbeddedIPv4(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		embedding Embedding
+		policy    EmbedPolicy
+		insert    string
+		lookup    string
+		key       string // GetKey(lookup); "" when nothing is found
+		reason    Reason // Insert's PrefixError reason, if any
+	}{
+		{Mapped, KeepIPv6, "::ffff:10.0.0.0/104", "::ffff:10.1.2.3", "::ffff:10.0.0.0/104", 0},
+		{Mapped, KeepIPv6, "::ffff:10.0.0.0/104", "10.1.2.3", "", 0},
+		{Mapped, UnmapIPv4, "::ffff:10.0.0.0/104", "10.1.2.3", "10.0.0.0/8", 0},
+		{Mapped, UnmapIPv4, "10.0.0.0/8", "::ffff:10.1.2.3", "10.0.0.0/8", 0},
+		{Mapped, UnmapIPv4, "::ffff:0:0/96", "8.8.8.8", "0.0.0.0/0", 0},
+		{Mapped, UnmapIPv4, "::ffff:0:0/80", "::ffff:8.8.8.8", "", 0},
+		{Mapped, UnmapIPv4, "::ffff:0:0/80", "::fffe:1:1", "::/80", 0},
+		{Mapped, RejectEmbedded, "::ffff:10.0.0.0/104", "::ffff:10.1.2.3", "", ReasonEmbeddedIPv4},
+		{Mapped, RejectEmbedded, "::/0", "::ffff:10.1.2.3", "", 0},
+		{Mapped, RejectEmbedded, "::/0", "::10.1.2.3", "::/0", 0},
+		{Compat, UnmapIPv4, "::10.0.0.0/104", "10.1.2.3", "10.0.0.0/8", 0},
+		{Compat, UnmapIPv4, "::1", "::1", "::1/128", 0},
+		{Compat, UnmapIPv4, "::ffff:10.0.0.0/104", "10.1.2.3", "", 0},
+		{Compat, RejectEmbedded, "::10.1.2.3", "::10.1.2.3", "", ReasonEmbeddedIPv4},
+		{NAT64, UnmapIPv4, "64:ff9b::192.0.2.0/120", "192.0.2.1", "192.0.2.0/24", 0},
+		{NAT64, UnmapIPv4, "64:ff9b:1::192.0.2.0/120", "192.0.2.1", "", 0},
+		{NAT64, KeepIPv6, "64:ff9b::192.0.2.0/120", "64:ff9b::192.0.2.1", "64:ff9b::c000:200/120", 0},
+		{NAT64, RejectEmbedded, "64:ff9b::/96", "64:ff9b::1", "", ReasonEmbeddedIPv4},
+	}
+	for i, c := range cases {
+		tr := NewTrie[int](WithEmbeddedIPv4(c.embedding, c.policy))
+		err := tr.Insert(c.insert, i)
+		var perr *PrefixError
+		if c.reason != 0 && (!errors.As(err, &perr) || perr.Reason != c.reason) || c.reason == 0 && err != nil {
+			t.Errorf("Error on test %d: %v", i+1, err)
+		}
+		if key := tr.GetKey(c.lookup); key != c.key {
+			t.Errorf("Error on test %d: got %q, want %q", i+1, key, c.key)
+		}
+	}
+
+	// The netip API follows the same policy.
+	tr := NewTrie[string](WithEmbeddedIPv4(Mapped, UnmapIPv4))
+	tr.InsertPrefix(netip.MustParsePrefix("::ffff:192.0.2.0/120"), "doc")
+	if key, v, ok := tr.LookupAddr(netip.MustParseAddr("::ffff:192.0.2.7")); !ok || v != "doc" || key.String() != "192.0.2.0/24" {
+		t.Errorf("Error on test %d: %v %v %v", len(cases)+1, key, v, ok)
+	}
+	if !tr.HasPrefix(netip.MustParsePrefix("192.0.2.0/24")) || len(tr.Keys()) != 1 {
+		t.Errorf("Error on test %d: %v", len(cases)+2, tr.Keys())
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		input  string
+		want   string // the parsed prefix, or "" on error
+		pos    int
+		reason Reason
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", 0, 0},
+		{"  10.0.0.0 / 8\n", "10.0.0.0/8", 0, 0},
+		{"8.8.8.8", "8.8.8.8/32", 0, 0},
+		{"10/8", "10.0.0.0/8", 0, 0},
+		{"172.16/12", "172.16.0.0/12", 0, 0},
+		{"192.168.1/24", "192.168.1.0/24", 0, 0},
+		{"::1", "::1/128", 0, 0},
+		{"1::", "1::/128", 0, 0},
+		{"::", "::/128", 0, 0},
+		{"fe80::1%eth0", "fe80::1/128", 0, 0},
+		{"fe80::1%eth0/64", "fe80::1/64", 0, 0},
+		{"[2001:db8::1]", "2001:db8::1/128", 0, 0},
+		{"[2001:db8::]/32", "2001:db8::/32", 0, 0},
+		{"[fe80::1%en0]/10", "fe80::1/10", 0, 0},
+		{"::ffff:10.0.0.0/104", "::ffff:10.0.0.0/104", 0, 0},
+		{"", "", 0, ReasonBadAddress},
+		{"   ", "", 3, ReasonBadAddress},
+		{"/8", "", 0, ReasonBadAddress},
+		{"10", "", 0, ReasonBadAddress},
+		{"10.0.0.0/8/8", "", 8, ReasonBadAddress},
+		{"10.0.x.0/24", "", 5, ReasonBadAddress},
+		{" 10.0.0.0 /", "", 11, ReasonBadMask},
+		{"[10.0.0.0]/8", "", 0, ReasonBadAddress},
+		{"[2001:db8::/32", "", 11, ReasonBadAddress},
+		{"[", "", 1, ReasonBadAddress},
+		{"[]", "", 1, ReasonBadAddress},
+		{"2001:db8::/-1", "", 11, ReasonBadMask},
+		{"10.0.0.0/40", "", 9, ReasonBadMask},
+	}
+	for i, c := range cases {
+		p, err := parseCIDR(c.input)
+		if c.want != "" {
+			if err != nil || p.String() != c.want {
+				t.Errorf("Error on test %d: %v %v", i+1, p, err)
+			}
+			continue
+		}
+		var perr *PrefixError
+		if !errors.As(err, &perr) || perr.Pos != c.pos || perr.Reason != c.reason {
+			t.Errorf("Error on test %d: %v", i+1, err)
+		}
+	}
+}
+
+func FuzzParseCIDR(f *testing.F) {
+	for _, seed := range []string{
+		"", "::1", "1::", "::", "10/8", "8.8.8.8", "10.1.2.3/8", "[::1]/64",
+		"fe80::1%eth0/64", " 10.0.0.0 / 8 ", "::ffff:1.2.3.4", "[", "/", "%",
+		"2001:db8::/129", "10.0.0.0/+8", "1.2.3.4.5", "[1.2.3.4]",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		p, err := parseCIDR(input)
+		if err != nil {
+			var perr *PrefixError
+			if !errors.As(err, &perr) || !errors.Is(err, ErrInvalidPrefix) {
+				t.Fatalf("%q: untyped error %v", input, err)
+			}
+			if perr.Input != input || perr.Pos < 0 || perr.Pos > len(input) {
+				t.Fatalf("%q: bad error %+v", input, perr)
+			}
+			return
+		}
+		if !p.IsValid() {
+			t.Fatalf("%q: invalid prefix without error", input)
+		}
+		// Whatever parses must survive a round trip, and be usable as a key.
+		if again, err := parseCIDR(p.String()); err != nil || again != p {
+			t.Fatalf("%q: %v reparsed as %v, %v", input, p, again, err)
+		}
+		tr := NewTrie[int]()
+		if err := tr.Insert(input, 1); err != nil || !tr.HasKey(input) {
+			t.Fatalf("%q: insert failed: %v", input, err)
+		}
+	})
+}
+
+func TestTrieAggregate(t *testing.T) {
+	t.Parallel()
+
+	same := func(a, b string) bool { return a == b }
+	build := func(cidrs ...string) *Trie[string] {
+		tr := NewTrie[string]()
+		for i := 0; i+1 < len(cidrs); i += 2 {
+			tr.Insert(cidrs[i], cidrs[i+1])
+		}
+		return tr
+	}
+
+	cases := []struct {
+		in   *Trie[string]
+		want string
+	}{
+		{build("10.0.0.0/25", "x", "10.0.0.128/25", "x"), "[10.0.0.0/24]"},
+		{build("10.0.0.0/25", "x", "10.0.0.128/25", "y"), "[10.0.0.0/25 10.0.0.128/25]"},
+		{build("10.0.0.0/8", "x", "10.1.0.0/16", "x", "10.1.1.0/24", "y"), "[10.0.0.0/8 10.1.1.0/24]"},
+		{build("10.0.0.0/8", "x", "10.1.0.0/16", "y", "10.1.1.0/24", "x"), "[10.0.0.0/8 10.1.0.0/16 10.1.1.0/24]"},
+		{build("10.0.0.0/24", "w", "10.0.0.0/26", "x", "10.0.0.64/26", "x", "10.0.0.128/26", "x", "10.0.0.192/26", "x"), "[10.0.0.0/24]"},
+		{build("0.0.0.0/1", "x", "128.0.0.0/1", "x", "2001:db8::/33", "x", "2001:db8:8000::/33", "x"), "[0.0.0.0/0 2001:db8::/32]"},
+		{build("10.0.0.0/25", "x", "10.0.0.128/25", "x", "10.0.0.128/26", "y"), "[10.0.0.0/24 10.0.0.128/26]"},
+		{build("10.0.0.0/24", "x", "10.0.1.0/24", "x", "10.0.0.0/23", "x", "10.0.0.0/22", "x"), "[10.0.0.0/22]"},
+	}
+	for i, c := range cases {
+		before := fmt.Sprint(c.in.Items())
+		if got := fmt.Sprint(c.in.Aggregate(same).Keys()); got != c.want {
+			t.Errorf("Error on test %d: %v", i+1, got)
+		}
+		if fmt.Sprint(c.in.Items()) != before {
+			t.Errorf("Error on test %d: Aggregate modified its input", i+1)
+		}
+	}
+
+	// Randomized: every address in (and just around) a small, crowded
+	// space must resolve to the same value before and after.
+	rng := rand.New(rand.NewSource(1))
+	for trial := 0; trial < 200; trial++ {
+		tr := NewTrie[string]()
+		for i := 0; i < 40; i++ {
+			tr.Insert(fmt.Sprintf("10.0.%d.%d/%d", rng.Intn(4), rng.Intn(256), 22+rng.Intn(11)), fmt.Sprint(rng.Intn(3)))
+			tr.Insert(fmt.Sprintf("2001:db8::%x/%d", rng.Intn(1024), 118+rng.Intn(11)), fmt.Sprint(rng.Intn(3)))
+		}
+		agg := tr.Aggregate(same)
+		if len(agg.Keys()) > len(tr.Keys()) {
+			t.Fatalf("Error on trial %d: %d keys grew to %d", trial, len(tr.Keys()), len(agg.Keys()))
+		}
+		for i := 0; i < 2048; i++ {
+			for _, a := range []netip.Addr{
+				netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}),
+				netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, 14: byte(i >> 8), 15: byte(i)}),
+			} {
+				_, want, wantOK := tr.LookupAddr(a)
+				_, got, gotOK := agg.LookupAddr(a)
+				if want != got || wantOK != gotOK {
+					t.Fatalf("Error on trial %d: %v resolves to %q/%v, was %q/%v", trial, a, got, gotOK, want, wantOK)
+				}
+			}
+		}
+		// A second pass finds nothing more to do.
+		if again := agg.Aggregate(same); fmt.Sprint(again.Items()) != fmt.Sprint(agg.Items()) {
+			t.Fatalf("Error on trial %d: not a fixed point", trial)
+		}
+	}
+
+	// In place: one write, with events for what changed.
+	tr := build("10.0.0.0/24", "w", "10.0.0.0/25", "x", "10.0.0.128/25", "x", "192.0.2.0/24", "z")
+	events, cancel := tr.Subscribe(netip.Prefix{})
+	defer cancel()
+	snap := tr.Snapshot()
+	tr.AggregateInPlace(same)
+	if fmt.Sprint(tr.Keys()) != "[10.0.0.0/24 192.0.2.0/24]" || len(snap.Keys()) != 4 {
+		t.Errorf("Error on test 9: %v", tr.Keys())
+	}
+	kinds := []string{}
+	for len(events) > 0 {
+		ev := <-events
+		kinds = append(kinds, ev.Kind.String()+" "+ev.Prefix.String())
+	}
+	if fmt.Sprint(kinds) != "[Replaced 10.0.0.0/24 Deleted 10.0.0.0/25 Deleted 10.0.0.128/25]" {
+		t.Errorf("Error on test 10: %v", kinds)
+	}
+
+	// A PyTricia aggregates into a PyTricia.
+	pt := NewPyTricia()
+	pt.Insert("10.0.0.0/9", "a")
+	pt.Insert("10.128.0.0/9", "a")
+	agg := pt.Aggregate(func(a, b any) bool { return a == b })
+	if fmt.Sprint(agg.Keys()) != "[10.0.0.0/8]" || agg.Get("10.1.1.1") != "a" || agg.Get("11.0.0.0") != nil {
+		t.Errorf("Error on test 11: %v", agg.Keys())
+	}
+	if children := agg.Children("10.1.0.0/16"); len(children) != 1 || children["10.0.0.0/8"] != "a" {
+		t.Errorf("Error on test 12: %v", children)
+	}
+}
+
+func TestTrieSetOps(t *testing.T) {
+	t.Parallel()
+
+	join := func(a, b string) string { return a + "+" + b }
+	build := func(cidrs ...string) *Trie[string] {
+		tr := NewTrie[string]()
+		for i := 0; i+1 < len(cidrs); i += 2 {
+			tr.Insert(cidrs[i], cidrs[i+1])
+		}
+		return tr
+	}
+
+	a := build("10.0.0.0/8", "a8", "10.1.2.0/24", "a24", "192.0.2.0/24", "doc", "2001:db8::/32", "a6")
+	b := build("10.1.0.0/16", "b16", "10.0.0.0/8", "b8", "2001:db8:1::/48", "b6", "198.51.100.0/24", "net2")
+
+	union := a.Union(b, join)
+	if fmt.Sprint(union.Items()) != "[{10.0.0.0/8 a8+b8} {10.1.0.0/16 b16} {10.1.2.0/24 a24} {192.0.2.0/24 doc} "+
+		"{198.51.100.0/24 net2} {2001:db8::/32 a6} {2001:db8:1::/48 b6}]" {
+		t.Errorf("Error on test 1: %v", union.Items())
+	}
+
+	inter := a.Intersect(b, join)
+	if fmt.Sprint(inter.Items()) != "[{10.0.0.0/8 a8+b8} {10.1.0.0/16 a8+b16} {10.1.2.0/24 a24+b16} {2001:db8:1::/48 a6+b6}]" {
+		t.Errorf("Error on test 2: %v", inter.Items())
+	}
+
+	diff := build("10.0.0.0/8", "x").Subtract(build("10.1.0.0/16", "y"))
+	if fmt.Sprint(diff.Keys()) != "[10.0.0.0/16 10.2.0.0/15 10.4.0.0/14 10.8.0.0/13 10.16.0.0/12 10.32.0.0/11 10.64.0.0/10 10.128.0.0/9]" {
+		t.Errorf("Error on test 3: %v", diff.Keys())
+	}
+	diff = a.Subtract(b)
+	if fmt.Sprint(diff.Keys()) != "[192.0.2.0/24 2001:db8::/48 2001:db8:2::/47 2001:db8:4::/46 2001:db8:8::/45 "+
+		"2001:db8:10::/44 2001:db8:20::/43 2001:db8:40::/42 2001:db8:80::/41 2001:db8:100::/40 "+
+		"2001:db8:200::/39 2001:db8:400::/38 2001:db8:800::/37 2001:db8:1000::/36 2001:db8:2000::/35 "+
+		"2001:db8:4000::/34 2001:db8:8000::/33]" {
+		t.Errorf("Error on test 4: %v", diff.Keys())
+	}
+	// t's own more specific prefixes are split in turn.
+	diff = build("10.0.0.0/8", "x", "10.0.0.0/16", "y").Subtract(build("10.0.1.0/24", "z"))
+	if fmt.Sprint(diff.Items()) != "[{10.0.0.0/24 y} {10.0.2.0/23 y} {10.0.4.0/22 y} {10.0.8.0/21 y} {10.0.16.0/20 y} "+
+		"{10.0.32.0/19 y} {10.0.64.0/18 y} {10.0.128.0/17 y} {10.1.0.0/16 x} {10.2.0.0/15 x} {10.4.0.0/14 x} "+
+		"{10.8.0.0/13 x} {10.16.0.0/12 x} {10.32.0.0/11 x} {10.64.0.0/10 x} {10.128.0.0/9 x}]" {
+		t.Errorf("Error on test 5: %v", diff.Items())
+	}
+
+	// Randomized: the results must answer every lookup as defined.
+	rng := rand.New(rand.NewSource(1))
+	random := func() *Trie[string] {
+		tr := NewTrie[string]()
+		for i := 0; i < 15; i++ {
+			tr.Insert(fmt.Sprintf("10.0.%d.%d/%d", rng.Intn(4), rng.Intn(256), 20+rng.Intn(13)), fmt.Sprint(i))
+		}
+		return tr
+	}
+	for trial := 0; trial < 100; trial++ {
+		a, b := random(), random()
+		union, inter, diff := a.Union(b, join), a.Intersect(b, join), a.Subtract(b)
+		for i := 0; i < 4096; i++ {
+			addr := netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})
+			pa, va, okA := a.LookupAddr(addr)
+			pb, vb, okB := b.LookupAddr(addr)
+
+			want, wantOK := va, okA
+			switch {
+			case okA && okB && pa == pb:
+				want = join(va, vb)
+			case okB && (!okA || pb.Bits() > pa.Bits()):
+				want, wantOK = vb, true
+			}
+			if _, got, ok := union.LookupAddr(addr); got != want || ok != wantOK {
+				t.Fatalf("Error on trial %d: union at %v gives %q, want %q", trial, addr, got, want)
+			}
+			if _, got, ok := inter.LookupAddr(addr); ok != (okA && okB) || ok && got != join(va, vb) {
+				t.Fatalf("Error on trial %d: intersection at %v gives %q", trial, addr, got)
+			}
+			if _, got, ok := diff.LookupAddr(addr); ok != (okA && !okB) || ok && got != va {
+				t.Fatalf("Error on trial %d: difference at %v gives %q", trial, addr, got)
+			}
+		}
+	}
+	// A nil trie reads as empty.
+	first := func(a, b string) string { return a }
+	tr := NewTrie[string]()
+	tr.Insert("10.0.0.0/8", "x")
+	var none *Trie[string]
+	if fmt.Sprint(tr.Union(none, first).Keys(), tr.Subtract(none).Keys(), len(tr.Intersect(none, first).Keys())) != "[10.0.0.0/8] [10.0.0.0/8] 0" {
+		t.Errorf("Error on test 6")
+	}
+	if fmt.Sprint(none.Union(tr, first).Keys(), none.Subtract(tr).Keys()) != "[10.0.0.0/8] []" {
+		t.Errorf("Error on test 7")
+	}
+
+	// PyTricias combine into PyTricias.
+	p, q := NewPyTricia(), NewPyTricia()
+	p.Insert("10.0.0.0/8", "x")
+	q.Insert("10.1.0.0/16", "y")
+	pick := func(a, b any) any { return a }
+	if u := p.Union(q, pick); u.Get("10.1.1.1") != "y" || u.Get("11.0.0.0") != nil {
+		t.Errorf("Error on test 8: %v", u.Keys())
+	}
+	if i := p.Intersect(q, pick); fmt.Sprint(i.Keys()) != "[10.1.0.0/16]" || i.Get("10.1.1.1") != "x" {
+		t.Errorf("Error on test 9: %v", i.Keys())
+	}
+	if d := p.Subtract(q); d.Get("10.1.1.1") != nil || d.Get("10.2.0.0") != "x" {
+		t.Errorf("Error on test 10: %v", d.Keys())
+	}
+	if u := p.Union(nil, pick); fmt.Sprint(u.Keys()) != "[10.0.0.0/8]" {
+		t.Errorf("Error on test 11: %v", u.Keys())
+	}
+}
+
+func TestTrieGaps(t *testing.T) {
+	t.Parallel()
+
+	tr := NewTrie[string]()
+	tr.Insert("10.0.0.0/8", "pool") // the parent: not an occupant
+	tr.Insert("10.0.0.0/24", "a")
+	tr.Insert("10.0.1.0/25", "b")
+	tr.Insert("10.0.4.0/22", "c")
+	tr.Insert("10.0.4.16/28", "inside c")
+	tr.Insert("11.0.0.0/24", "outside")
+
+	within := netip.MustParsePrefix("10.0.0.0/21")
+	if got := fmt.Sprint(tr.Gaps(within)); got != "[10.0.1.128/25 10.0.2.0/23]" {
+		t.Errorf("Error on test 1: %v", got)
+	}
+	if got := fmt.Sprint(tr.Gaps(netip.MustParsePrefix("10.0.0.0/8"))); got != "[10.0.1.128/25 10.0.2.0/23 10.0.8.0/21 "+
+		"10.0.16.0/20 10.0.32.0/19 10.0.64.0/18 10.0.128.0/17 10.1.0.0/16 10.2.0.0/15 10.4.0.0/14 10.8.0.0/13 "+
+		"10.16.0.0/12 10.32.0.0/11 10.64.0.0/10 10.128.0.0/9]" {
+		t.Errorf("Error on test 2: %v", got)
+	}
+	if got := fmt.Sprint(tr.Gaps(netip.MustParsePrefix("10.0.4.0/22"))); got != "[10.0.4.0/28 10.0.4.32/27 10.0.4.64/26 "+
+		"10.0.4.128/25 10.0.5.0/24 10.0.6.0/23]" {
+		t.Errorf("Error on test 3: %v", got)
+	}
+	if got := fmt.Sprint(tr.Gaps(netip.MustParsePrefix("10.0.0.0/24"))); got != "[10.0.0.0/24]" {
+		t.Errorf("Error on test 4: %v", got)
+	}
+	if got := fmt.Sprint(tr.Gaps(netip.MustParsePrefix("10.0.0.0/26"))); got != "[10.0.0.0/26]" { // only stored above
+		t.Errorf("Error on test 5: %v", got)
+	}
+	if got := fmt.Sprint(NewTrie[int]().Gaps(netip.MustParsePrefix("::/0"))); got != "[::/0]" {
+		t.Errorf("Error on test 6: %v", got)
+	}
+	if got := fmt.Sprint(tr.Gaps(netip.MustParsePrefix("2001:db8::/32"))); got != "[2001:db8::/32]" {
+		t.Errorf("Error on test 7: %v", got)
+	}
+
+	allocs := []struct {
+		length int
+		want   string
+	}{
+		{24, "10.0.2.0/24"},
+		{25, "10.0.1.128/25"},
+		{23, "10.0.2.0/23"},
+		{32, "10.0.1.128/32"},
+	}
+	for i, c := range allocs {
+		p, err := tr.AllocateFree(within, c.length)
+		if err != nil || p.String() != c.want {
+			t.Errorf("Error on test %d: %v %v", 8+i, p, err)
+		}
+	}
+	if _, err := tr.AllocateFree(within, 22); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Error on test 12: %v", err)
+	}
+	if _, err := tr.AllocateFree(within, 20); !errors.Is(err, ErrInvalidPrefix) {
+		t.Errorf("Error on test 13: %v", err)
+	}
+	if _, err := tr.AllocateFree(within, 33); !errors.Is(err, ErrInvalidPrefix) {
+		t.Errorf("Error on test 14: %v", err)
+	}
+
+	// Allocating fills the space in address order.
+	for i := 0; i < 2; i++ {
+		p, _ := tr.AllocateFree(within, 24)
+		tr.InsertPrefix(p, "new")
+	}
+	if got := fmt.Sprint(tr.Gaps(within)); got != "[10.0.1.128/25]" {
+		t.Errorf("Error on test 15: %v", got)
+	}
+
+	// Lengths count in the family a prefix is stored as.
+	unmapped := NewTrie[string](WithEmbeddedIPv4(Mapped, UnmapIPv4))
+	unmapped.Insert("10.0.0.0/24", "used")
+	mapped := netip.MustParsePrefix("::ffff:10.0.0.0/104")
+	if p, err := unmapped.AllocateFree(mapped, 60); !errors.Is(err, ErrInvalidPrefix) {
+		t.Errorf("Error on test 16: %v %v", p, err)
+	}
+	if p, err := unmapped.AllocateFree(mapped, 24); err != nil || p.String() != "10.0.1.0/24" {
+		t.Errorf("Error on test 17: %v %v", p, err)
+	}
+}
+
+func TestTrieRanges(t *testing.T) {
+	t.Parallel()
+
+	same := func(a, b string) bool { return a == b }
+
+	tr := NewTrie[string]()
+	if err := tr.InsertRange("1.2.3.4", "1.2.9.17", "feed"); err != nil {
+		t.Errorf("Error on test 1: %v", err)
+	}
+	if fmt.Sprint(tr.Keys()) != "[1.2.3.4/30 1.2.3.8/29 1.2.3.16/28 1.2.3.32/27 1.2.3.64/26 1.2.3.128/25 "+
+		"1.2.4.0/22 1.2.8.0/24 1.2.9.0/28 1.2.9.16/31]" {
+		t.Errorf("Error on test 2: %v", tr.Keys())
+	}
+	if fmt.Sprint(tr.Ranges(same)) != "[{1.2.3.4 1.2.9.17 feed}]" {
+		t.Errorf("Error on test 3: %v", tr.Ranges(same))
+	}
+	if v, ok := tr.Get("1.2.9.17"); !ok || v != "feed" || tr.Contains("1.2.9.18") || tr.Contains("1.2.3.3") {
+		t.Errorf("Error on test 4")
+	}
+
+	// Partly covered prefixes survive DeleteRange.
+	tr.Insert("1.2.0.0/16", "wide")
+	if err := tr.DeleteRange("1.2.3.0", "1.2.5.255"); err != nil {
+		t.Errorf("Error on test 5: %v", err)
+	}
+	if fmt.Sprint(tr.Keys()) != "[1.2.0.0/16 1.2.4.0/22 1.2.8.0/24 1.2.9.0/28 1.2.9.16/31]" {
+		t.Errorf("Error on test 6: %v", tr.Keys())
+	}
+	if fmt.Sprint(tr.Ranges(same)) != "[{1.2.0.0 1.2.3.255 wide} {1.2.4.0 1.2.9.17 feed} {1.2.9.18 1.2.255.255 wide}]" {
+		t.Errorf("Error on test 7: %v", tr.Ranges(same))
+	}
+
+	nested := NewTrie[string]()
+	nested.Insert("10.0.0.0/8", "a")
+	nested.Insert("10.1.0.0/16", "b")
+	nested.Insert("10.1.0.0/24", "a")
+	nested.Insert("2001:db8::/32", "v6")
+	if fmt.Sprint(nested.Ranges(same)) != "[{10.0.0.0 10.1.0.255 a} {10.1.1.0 10.1.255.255 b} {10.2.0.0 10.255.255.255 a} "+
+		"{2001:db8:: 2001:db8:ffff:ffff:ffff:ffff:ffff:ffff v6}]" {
+		t.Errorf("Error on test 8: %v", nested.Ranges(same))
+	}
+
+	full := NewTrie[int]()
+	full.InsertRange("0.0.0.0", "255.255.255.255", 1)
+	full.InsertRangeAddr(netip.MustParseAddr("2001:db8::"), netip.MustParseAddr("2001:db8::ffff"), 2)
+	if fmt.Sprint(full.Keys()) != "[0.0.0.0/0 2001:db8::/112]" {
+		t.Errorf("Error on test 9: %v", full.Keys())
+	}
+
+	errs := []struct {
+		start, end string
+		want       error
+	}{
+		{"1.2.3.5", "1.2.3.4", ErrInvalidRange},
+		{"1.2.3.4", "::1", ErrInvalidRange},
+		{"1.2.3.0/24", "1.2.3.255", ErrInvalidPrefix},
+		{"1.2.3.4", "nonsense", ErrInvalidPrefix},
+	}
+	for i, c := range errs {
+		if err := full.InsertRange(c.start, c.end, 0); !errors.Is(err, c.want) {
+			t.Errorf("Error on test %d: %v", 10+i, err)
+		}
+	}
+
+	// Randomized: ranges are ordered, disjoint, fully coalesced, and
+	// agree with LookupAddr everywhere.
+	rng := rand.New(rand.NewSource(1))
+	for trial := 0; trial < 100; trial++ {
+		tr := NewTrie[string]()
+		for i := 0; i < 20; i++ {
+			tr.Insert(fmt.Sprintf("10.0.%d.%d/%d", rng.Intn(4), rng.Intn(256), 20+rng.Intn(13)), fmt.Sprint(rng.Intn(3)))
+		}
+		from := netip.AddrFrom4([4]byte{10, 0, byte(rng.Intn(4)), byte(rng.Intn(256))})
+		to := netip.AddrFrom4([4]byte{10, 0, 3, byte(rng.Intn(256))})
+		tr.InsertRangeAddr(from, to, "r")
+
+		ranges := tr.Ranges(same)
+		for i := 1; i < len(ranges); i++ {
+			prev, cur := ranges[i-1], ranges[i]
+			if !prev.End.Less(cur.Start) || prev.End.Next() == cur.Start && prev.Value == cur.Value {
+				t.Fatalf("Error on trial %d: %v then %v", trial, prev, cur)
+			}
+		}
+		for i := 0; i < 4096; i++ {
+			addr := netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})
+			_, want, ok := tr.LookupAddr(addr)
+			found := false
+			for _, r := range ranges {
+				if !addr.Less(r.Start) && !r.End.Less(addr) {
+					found = true
+					if r.Value != want {
+						t.Fatalf("Error on trial %d: %v in %v, LookupAddr says %q", trial, addr, r, want)
+					}
+				}
+			}
+			if found != ok {
+				t.Fatalf("Error on trial %d: %v covered %v, LookupAddr %v", trial, addr, found, ok)
+			}
+		}
+	}
+	// A covering prefix the policies refuse fails the whole delete.
+	strict := NewTrie[string](WithEmbeddedIPv4(Mapped, RejectEmbedded))
+	strict.Insert("::fffe:0:0/96", "kept")
+	var pe *PrefixError
+	if err := strict.DeleteRange("::fffe:0:0", "::ffff:0:ff"); !errors.As(err, &pe) || pe.Reason != ReasonEmbeddedIPv4 {
+		t.Errorf("Error on test 10: %v", err)
+	}
+	if fmt.Sprint(strict.Keys()) != "[::fffe:0:0/96]" {
+		t.Errorf("Error on test 11: %v", strict.Keys())
+	}
+}
+
+// stringCodec stores strings as their raw bytes, keeping fixtures
+// independent of gob.
+type stringCodec struct{}
+
+func (stringCodec) Encode(v string) ([]byte, error) { return []byte(v), nil }
+func (stringCodec) Decode(b []byte) (string, error) { return string(b), nil }
+
+// fixtureTrie is the content of testdata/trie-v1.bin.
+func fixtureTrie() *Trie[string] {
+	tr := NewTrie[string](WithKeyMode(PreserveOriginalKey), WithCodec[string](stringCodec{}))
+	for _, kv := range [][2]string{
+		{"0.0.0.0/0", "default"}, {"10.0.0.0/8", "ten"}, {"10.1.2.3/16", "host bits kept"},
+		{"192.0.2.0/24", ""}, {"2001:db8::/32", "doc6"}, {"2001:db8::1", "host"},
+	} {
+		tr.Insert(kv[0], kv[1])
+	}
+	return tr
+}
+
+// fixturePyTricia is the content of testdata/pytricia-v1.bin: one
+// value of each kind DefaultCodec tells apart.
+func fixturePyTricia() *PyTricia {
+	pt := NewPyTricia()
+	for i, v := range []any{"s", []byte{1, 2}, true, 42, int64(-7), uint(7), uint64(8), 3.5, nil, []string{"gob"}} {
+		pt.Insert(fmt.Sprintf("10.0.0.%d", i), v)
+	}
+	return pt
+}
+
+func TestTrieBinary(t *testing.T) {
+	t.Parallel()
+
+	// Format version 1 must stay readable, byte for byte.
+	golden, err := os.ReadFile("testdata/trie-v1.bin")
+	if err != nil {
+		t.Fatalf("Error on test 1: %v", err)
+	}
+	tr := NewTrie[string](WithKeyMode(PreserveOriginalKey), WithCodec[string](stringCodec{}))
+	if err := tr.UnmarshalBinary(golden); err != nil {
+		t.Fatalf("Error on test 2: %v", err)
+	}
+	want := fixtureTrie()
+	if fmt.Sprint(tr.Items()) != fmt.Sprint(want.Items()) {
+		t.Errorf("Error on test 3: %v", tr.Items())
+	}
+	if data, err := want.MarshalBinary(); err != nil || !bytes.Equal(data, golden) {
+		t.Errorf("Error on test 4: %v\n%x\n%x", err, data, golden)
+	}
+	if tr.GetKey("10.1.9.9") != "10.1.2.3/16" {
+		t.Errorf("Error on test 5: %v", tr.GetKey("10.1.9.9"))
+	}
+
+	// DefaultCodec's encoding is part of the format too.
+	goldenPT, err := os.ReadFile("testdata/pytricia-v1.bin")
+	if err != nil {
+		t.Fatalf("Error on test 6: %v", err)
+	}
+	pt := NewPyTricia()
+	if err := pt.UnmarshalBinary(goldenPT); err != nil {
+		t.Fatalf("Error on test 7: %v", err)
+	}
+	if got, want := fmt.Sprintf("%#v", pt.Values()), fmt.Sprintf("%#v", fixturePyTricia().Values()); got != want {
+		t.Errorf("Error on test 8: %v", got)
+	}
+	if data, err := fixturePyTricia().MarshalBinary(); err != nil || !bytes.Equal(data, goldenPT) {
+		t.Errorf("Error on test 9: %v", err)
+	}
+
+	// Round trips with the default codec.
+	pt = NewPyTricia()
+	for i := 0; i < 1000; i++ {
+		pt.Insert(randomIPv4CIDR(), i)
+		pt.Insert(randomIPv6CIDR(), fmt.Sprint(i))
+	}
+	pt.Insert("::/0", nil)
+	data, err := pt.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error on test 10: %v", err)
+	}
+	back := NewPyTricia()
+	if err := back.UnmarshalBinary(data); err != nil || fmt.Sprint(back.Items()) != fmt.Sprint(pt.Items()) {
+		t.Errorf("Error on test 11: %v", err)
+	}
+	checkCompressed(t, back.load().v4, true)
+	checkCompressed(t, back.load().v6, true)
+
+	// Streams: ReadFrom stops at the end of each trie.
+	var buf bytes.Buffer
+	n1, err1 := want.WriteTo(&buf)
+	n2, err2 := NewTrie[string](WithCodec[string](stringCodec{})).WriteTo(&buf)
+	if err1 != nil || err2 != nil || n1+n2 != int64(buf.Len()) {
+		t.Errorf("Error on test 12: %v %v", err1, err2)
+	}
+	r := bufio.NewReader(&buf)
+	first, second := NewTrie[string](WithCodec[string](stringCodec{})), fixtureTrie()
+	if n, err := first.ReadFrom(r); err != nil || n != n1 || len(first.Keys()) != 6 {
+		t.Errorf("Error on test 13: %v %v", n, err)
+	}
+	if n, err := second.ReadFrom(r); err != nil || n != n2 || len(second.Keys()) != 0 {
+		t.Errorf("Error on test 14: %v %v", n, err)
+	}
+
+	// Corruption anywhere is caught, never a panic.
+	for i := range golden {
+		bad := bytes.Clone(golden)
+		bad[i] ^= 0x41
+		if err := tr.UnmarshalBinary(bad); !errors.Is(err, ErrBadFormat) {
+			t.Errorf("Error on test 15: byte %d: %v", i, err)
+		}
+		if err := tr.UnmarshalBinary(golden[:i]); !errors.Is(err, ErrBadFormat) {
+			t.Errorf("Error on test 16: length %d: %v", i, err)
+		}
+	}
+	if err := tr.UnmarshalBinary(append(bytes.Clone(golden), 0)); !errors.Is(err, ErrBadFormat) {
+		t.Errorf("Error on test 17: %v", err)
+	}
+	if fmt.Sprint(tr.Items()) != fmt.Sprint(want.Items()) {
+		t.Errorf("Error on test 18: failed reads changed the trie")
+	}
+
+	// A codec for the wrong value type is refused.
+	if _, err := NewTrie[int](WithCodec[string](stringCodec{})).MarshalBinary(); err == nil {
+		t.Errorf("Error on test 19")
+	}
+
+	// Keys go through the reader's options, not the writer's.
+	src := NewTrie[int]()
+	src.Insert("::ffff:10.0.0.0/104", 1)
+	src.Insert("192.0.2.0/24", 2)
+	src.Insert("2001:db8::/32", 3)
+	data, err = src.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Error on test 20: %v", err)
+	}
+	unmapped := NewTrie[int](WithEmbeddedIPv4(Mapped, UnmapIPv4))
+	if err := unmapped.UnmarshalBinary(data); err != nil {
+		t.Fatalf("Error on test 21: %v", err)
+	}
+	if fmt.Sprint(unmapped.Keys()) != "[10.0.0.0/8 192.0.2.0/24 2001:db8::/32]" {
+		t.Errorf("Error on test 22: %v", unmapped.Keys())
+	}
+	if v, ok := unmapped.Get("::ffff:10.1.1.1"); !ok || v != 1 || !unmapped.HasKey("::ffff:10.0.0.0/104") {
+		t.Errorf("Error on test 23: %v %v", v, ok)
+	}
+	if err := unmapped.Delete("::ffff:10.0.0.0/104"); err != nil || len(unmapped.Keys()) != 2 {
+		t.Errorf("Error on test 24: %v", err)
+	}
+	checkCompressed(t, unmapped.load().v4, true)
+	checkCompressed(t, unmapped.load().v6, true)
+	src.Insert("10.0.0.0/8", 4)
+	data, _ = src.MarshalBinary()
+	if err := unmapped.UnmarshalBinary(data); !errors.Is(err, ErrExists) {
+		t.Errorf("Error on test 25: %v", err)
+	}
+	strict := NewTrie[string](WithKeyMode(RejectHostBits), WithCodec[string](stringCodec{}))
+	if err := strict.UnmarshalBinary(golden); !errors.As(err, new(*PrefixError)) || len(strict.Keys()) != 0 {
+		t.Errorf("Error on test 26: %v %v", err, strict.Keys())
+	}
+	normal := NewTrie[string](WithCodec[string](stringCodec{}))
+	if err := normal.UnmarshalBinary(golden); err != nil || normal.GetKey("10.1.9.9") != "10.1.0.0/16" {
+		t.Errorf("Error on test 27: %v %v", err, normal.GetKey("10.1.9.9"))
+	}
+	if data, err := normal.MarshalBinary(); err != nil || bytes.Equal(data, golden) {
+		t.Errorf("Error on test 28: original keys kept in Normalize mode")
+	}
+}
+
+func TestTrieJSON(t *testing.T) {
+	t.Parallel()
+
+	// Sorted, keys as written in PreserveOriginalKey mode.
+	tr := fixtureTrie()
+	data, err := json.Marshal(tr)
+	if err != nil {
+		t.Fatalf("Error on test 1: %v", err)
+	}
+	want := `[{"prefix":"0.0.0.0/0","value":"default"},{"prefix":"10.0.0.0/8","value":"ten"},` +
+		`{"prefix":"10.1.2.3/16","value":"host bits kept"},{"prefix":"192.0.2.0/24","value":""},` +
+		`{"prefix":"2001:db8::/32","value":"doc6"},{"prefix":"2001:db8::1/128","value":"host"}]`
+	if string(data) != want {
+		t.Errorf("Error on test 2: %s", data)
+	}
+	back := NewTrie[string](WithKeyMode(PreserveOriginalKey))
+	back.Insert("172.16.0.0/12", "gone")
+	if err := json.Unmarshal(data, back); err != nil || fmt.Sprint(back.Items()) != fmt.Sprint(tr.Items()) {
+		t.Errorf("Error on test 3: %v %v", err, back.Items())
+	}
+	if data, err := json.Marshal(NewTrie[int]()); err != nil || string(data) != "[]" {
+		t.Errorf("Error on test 4: %v %s", err, data)
+	}
+
+	text, err := tr.MarshalText()
+	if err != nil || !bytes.HasPrefix(text, []byte("0.0.0.0/0\t\"default\"\n10.0.0.0/8\t\"ten\"\n")) ||
+		bytes.Count(text, []byte("\n")) != 6 {
+		t.Errorf("Error on test 5: %v %q", err, text)
+	}
+
+	// Unsorted input is fine; the trie's key mode applies.
+	nums := NewTrie[int]()
+	if err := nums.UnmarshalJSON([]byte(`[{"prefix":"10.1.2.3/8","value":1},{"prefix":"0.0.0.0/0"}]`)); err != nil {
+		t.Fatalf("Error on test 6: %v", err)
+	}
+	if fmt.Sprint(nums.Items()) != "[{0.0.0.0/0 0} {10.0.0.0/8 1}]" {
+		t.Errorf("Error on test 7: %v", nums.Items())
+	}
+	strict := NewTrie[int](WithKeyMode(RejectHostBits))
+	strict.Insert("10.0.0.0/8", 1)
+	var pe *PrefixError
+	if err := strict.UnmarshalJSON([]byte(`[{"prefix":"10.1.2.3/8","value":1}]`)); !errors.As(err, &pe) || pe.Reason != ReasonHostBits {
+		t.Errorf("Error on test 8: %v", err)
+	}
+	if v, _ := strict.Get("10.0.0.0/8"); v != 1 {
+		t.Errorf("Error on test 9: failed write changed the trie")
+	}
+
+	for i, bad := range []string{
+		`{}`,
+		`[{"prefix":"10.0.0.0/33","value":1}]`,
+		`[{"prefix":"10.0.0.0/8","value":"one"}]`,
+		`[{"prefix":"10.0.0.0/8","value":1},{"prefix":"10.0.0.0/8","value":2}]`,
+	} {
+		if err := NewTrie[int]().UnmarshalJSON([]byte(bad)); err == nil {
+			t.Errorf("Error on test 10.%d: %s accepted", i, bad)
+		}
+	}
+	if err := NewTrie[int]().UnmarshalJSON([]byte(`[{"prefix":"10.0.0.0/8","value":1},{"prefix":"10.1.0.0/8","value":2}]`)); !errors.Is(err, ErrExists) {
+		t.Errorf("Error on test 11: %v", err)
+	}
+
+	// The hook decodes into concrete types; a mismatched one is refused.
+	type route struct{ Via string }
+	pt := NewPyTricia(WithJSONDecoder(func(data json.RawMessage) (any, error) {
+		var r route
+		err := json.Unmarshal(data, &r)
+		return r, err
+	}))
+	if err := json.Unmarshal([]byte(`[{"prefix":"10.0.0.0/8","value":{"Via":"a"}}]`), pt); err != nil {
+		t.Fatalf("Error on test 12: %v", err)
+	}
+	if r, ok := pt.Get("10.1.1.1").(route); !ok || r.Via != "a" {
+		t.Errorf("Error on test 13: %#v", pt.Get("10.1.1.1"))
+	}
+	wrong := NewTrie[int](WithJSONDecoder(func(json.RawMessage) (string, error) { return "", nil }))
+	if err := wrong.UnmarshalJSON([]byte(`[]`)); err == nil {
+		t.Errorf("Error on test 14: wrong decoder type accepted")
+	}
+
+	// Subscribers see the replacement.
+	sub := NewTrie[int]()
+	events, cancel := sub.Subscribe(netip.Prefix{})
+	defer cancel()
+	sub.UnmarshalJSON([]byte(`[{"prefix":"10.0.0.0/8","value":1}]`))
+	if ev := <-events; ev.Kind != Cleared {
+		t.Errorf("Error on test 15: %v", ev)
+	}
+	if ev := <-events; ev.Kind != Added || ev.Prefix.String() != "10.0.0.0/8" || ev.Value != 1 {
+		t.Errorf("Error on test 16: %v", ev)
+	}
+}
+
+func TestMappedTrie(t *testing.T) {
+	t.Parallel()
+
+	// Format version 1 must stay readable, byte for byte.
+	golden, err := os.ReadFile("testdata/trie-mapped-v1.bin")
+	if err != nil {
+		t.Fatalf("Error on test 1: %v", err)
+	}
+	fixture := fixtureTrie()
+	var buf bytes.Buffer
+	if n, err := fixture.WriteMapped(&buf); err != nil || n != int64(buf.Len()) || !bytes.Equal(buf.Bytes(), golden) {
+		t.Errorf("Error on test 2: %v %d\n%x\n%x", err, n, buf.Bytes(), golden)
+	}
+	m, err := OpenMappedTrie[string]("testdata/trie-mapped-v1.bin", WithKeyMode(PreserveOriginalKey), WithCodec[string](stringCodec{}))
+	if err != nil {
+		t.Fatalf("Error on test 3: %v", err)
+	}
+	defer m.Close()
+	if m.GetKey("10.1.9.9") != "10.1.2.3/16" {
+		t.Errorf("Error on test 4: %v", m.GetKey("10.1.9.9"))
+	}
+	if fmt.Sprint(m.GetAll("2001:db8::1")) != "[{2001:db8::1/128 host} {2001:db8::/32 doc6}]" {
+		t.Errorf("Error on test 5: %v", m.GetAll("2001:db8::1"))
+	}
+	if v, ok := m.Get("192.0.2.1"); !ok || v != "" {
+		t.Errorf("Error on test 6: %q %v", v, ok)
+	}
+
+	// The same queries give the same answers, whichever reader runs them.
+	tr := NewTrie[string]()
+	for i := 0; i < 500; i++ {
+		cidr := randomIPv4CIDR()
+		if i%2 == 1 {
+			cidr = randomIPv6CIDR()
+		}
+		tr.Insert(cidr, cidr)
+	}
+	tr.Insert("0.0.0.0/0", "default")
+	path := t.TempDir() + "/trie.map"
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Error on test 7: %v", err)
+	}
+	if _, err := tr.WriteMapped(f); err != nil {
+		t.Fatalf("Error on test 8: %v", err)
+	}
+	f.Close()
+	mapped, err := OpenMappedTrie[string](path)
+	if err != nil {
+		t.Fatalf("Error on test 9: %v", err)
+	}
+	defer mapped.Close()
+	snap := tr.Snapshot()
+	queries := []string{"0.0.0.0/0", "::/0", "not an ip", "10.0.0.0/33"}
+	for i := 0; i < 500; i++ {
+		queries = append(queries, randomIPv4(), randomIPv6(), randomIPv4CIDR(), randomIPv6CIDR())
+	}
+	for _, item := range tr.Items() {
+		queries = append(queries, item.Prefix.String())
+	}
+	for _, q := range queries {
+		want := answers(tr, q)
+		for j, r := range []Reader[string]{snap, mapped} {
+			if got := answers(r, q); got != want {
+				t.Fatalf("Error on test 10.%d: %s\n%s\n%s", j, q, got, want)
+			}
+		}
+	}
+
+	// PyTricia code switches by constructor.
+	pt := NewPyTricia()
+	pt.Insert("10.0.0.0/8", 8)
+	pt.Insert("10.1.0.0/16", nil)
+	path = t.TempDir() + "/py.map"
+	f, _ = os.Create(path)
+	pt.WriteMapped(f)
+	f.Close()
+	mpt, err := OpenMappedPyTricia(path)
+	if err != nil {
+		t.Fatalf("Error on test 11: %v", err)
+	}
+	defer mpt.Close()
+	for j, r := range []PyReader{pt, mpt} {
+		if r.Get("10.2.0.0/16") != 8 || r.Get("10.1.1.1") != nil || !r.Contains("10.1.1.1") || r.Get("11.0.0.0") != nil {
+			t.Errorf("Error on test 12.%d", j)
+		}
+		if key, value := r.GetKV("10.9.9.9"); key != "10.0.0.0/8" || value != 8 {
+			t.Errorf("Error on test 13.%d: %v %v", j, key, value)
+		}
+	}
+	if err := mpt.Err(); err != nil {
+		t.Errorf("Error on test 14: %v", err)
+	}
+
+	// A value that does not decode reads as missing, and Err says why.
+	var pbuf bytes.Buffer
+	pt.WriteMapped(&pbuf)
+	pdata := pbuf.Bytes()
+	values := len(pdata) - int(binary.BigEndian.Uint64(pdata[16:]))
+	for i := values; i < len(pdata); i++ {
+		pdata[i] = 0xff
+	}
+	damaged, err := NewMappedTrie[any](pdata)
+	if err != nil {
+		t.Fatalf("Error on test 15: %v", err)
+	}
+	if _, _, ok := damaged.LookupAddr(netip.MustParseAddr("10.2.0.0")); ok || !errors.Is(damaged.Err(), ErrBadFormat) {
+		t.Errorf("Error on test 16: %v %v", ok, damaged.Err())
+	}
+
+	// Bad files are refused at open; damaged records never crash a lookup.
+	data := buf.Bytes()
+	for i, bad := range [][]byte{nil, data[:31], data[:len(data)-1], append(slices.Clone(data), 0), []byte("PYTR" + string(data[4:]))} {
+		if _, err := NewMappedTrie[string](bad, WithCodec[string](stringCodec{})); !errors.Is(err, ErrBadFormat) {
+			t.Errorf("Error on test 17.%d: %v", i, err)
+		}
+	}
+	if _, err := OpenMappedTrie[string](t.TempDir() + "/missing"); err == nil {
+		t.Errorf("Error on test 18: missing file opened")
+	}
+	if _, err := NewMappedTrie[int](data, WithCodec[string](stringCodec{})); err == nil {
+		t.Errorf("Error on test 19: string codec used for ints")
+	}
+	for i := mappedHeader; i < len(data); i++ {
+		for _, x := range []byte{0x01, 0x80, 0xff} {
+			bad := slices.Clone(data)
+			bad[i] ^= x
+			m, err := NewMappedTrie[string](bad, WithCodec[string](stringCodec{}))
+			if err != nil {
+				continue
+			}
+			for _, q := range []string{"10.1.2.3", "2001:db8::1", "192.0.2.0/24", "::/0"} {
+				answers(m, q)
+			}
+		}
+	}
+}
+
+// answers renders everything r says about q.
+func answers(r Reader[string], q string) string {
+	v, ok := r.Get(q)
+	k, kv, kok := r.GetKV(q)
+	return fmt.Sprint(v, ok, r.GetKey(q), k, kv, kok, r.Contains(q), r.HasKey(q), r.GetAll(q))
+}
+
+func TestMMDB(t *testing.T) {
+	t.Parallel()
+
+	// testdata/mkmmdb.py builds these apart from the writer: 28- and
+	// 32-bit records, pointers, IPv4 aliases and every data type.
+	f, err := os.Open("testdata/fixture-ipv6-28.mmdb")
+	if err != nil {
+		t.Fatalf("Error on test 1: %v", err)
+	}
+	defer f.Close()
+	pt, meta, err := ReadMMDB(f)
+	if err != nil {
+		t.Fatalf("Error on test 2: %v", err)
+	}
+	if fmt.Sprintf("%+v", *meta) != "{DatabaseType:Fixture Description:map[de:Testdaten en:Test fixture] "+
+		"Languages:[en de] IPVersion:6 RecordSize:28 NodeCount:169 BuildEpoch:1700000000}" {
+		t.Errorf("Error on test 3: %+v", *meta)
+	}
+	if fmt.Sprint(pt.Keys()) != "[1.0.0.0/24 1.0.1.0/24 10.0.0.0/8 2001:db8::/33 2001:db8:8000::/33]" {
+		t.Errorf("Error on test 4: %v", pt.Keys()) // no ::ffff:0:0/96 or 2002::/16 aliases
+	}
+	au := pt.Get("1.0.1.5").(map[string]any)
+	if fmt.Sprint(au) != "map[asn:13335 country:map[names:map[en:Australia]] name:AU]" || au["asn"] != uint64(13335) {
+		t.Errorf("Error on test 5: %#v", au)
+	}
+	ten := pt.Get("10.9.9.9").(map[string]any)
+	for name, want := range map[string]any{
+		"name": "ten", "i32": -1, "u16": uint64(443), "u64": uint64(1 << 40), "f32": float32(0.5),
+		"f64": 1.25, "yes": true, "no": false,
+	} {
+		if ten[name] != want {
+			t.Errorf("Error on test 6: %s is %#v", name, ten[name])
+		}
+	}
+	if u128, ok := ten["u128"].(*big.Int); !ok || u128.Cmp(new(big.Int).Lsh(big.NewInt(1), 100)) != 0 {
+		t.Errorf("Error on test 7: %#v", ten["u128"])
+	}
+	if fmt.Sprintf("%x %v %d", ten["raw"], ten["list"], len(ten["long"].(string))) != "deadbeef [a 0 []] 300" {
+		t.Errorf("Error on test 8: %#v %#v", ten["raw"], ten["list"])
+	}
+	if fmt.Sprint(pt.Get("2001:db8::1")) != "map[country:Australia name:doc]" || pt.Get("2002:100:1::1") != nil {
+		t.Errorf("Error on test 9: %v", pt.Get("2001:db8::1"))
+	}
+
+	f4, err := os.Open("testdata/fixture-ipv4-32.mmdb")
+	if err != nil {
+		t.Fatalf("Error on test 10: %v", err)
+	}
+	defer f4.Close()
+	pt4, meta4, err := ReadMMDB(f4)
+	if err != nil || fmt.Sprint(pt4.Items()) != "[{0.0.0.0/1 map[half:1]} {192.0.2.0/24 map[half:2]}]" || meta4.RecordSize != 32 {
+		t.Errorf("Error on test 11: %v %v", err, pt4.Items())
+	}
+
+	// The writer's output must stay byte for byte.
+	golden, err := os.ReadFile("testdata/written-24.mmdb")
+	if err != nil {
+		t.Fatalf("Error on test 12: %v", err)
+	}
+	fixture := fixtureMMDB()
+	var buf bytes.Buffer
+	n, err := fixture.WriteMMDB(&buf, MMDBMetadata{
+		DatabaseType: "Written", Languages: []string{"en"},
+		Description: map[string]string{"en": "Written by WriteMMDB"}, BuildEpoch: 1700000000,
+	})
+	if err != nil || n != int64(buf.Len()) || !bytes.Equal(buf.Bytes(), golden) {
+		t.Errorf("Error on test 13: %v %d", err, n)
+	}
+
+	// Whatever the record size, the database answers as the trie does.
+	tr := NewPyTricia()
+	for i := 0; i < 300; i++ {
+		cidr := randomIPv4CIDR()
+		if i%3 == 0 {
+			cidr = randomIPv6CIDR()
+		}
+		tr.Insert(cidr, map[string]any{"i": uint64(i)})
+	}
+	queries := []string{"0.0.0.0", "::", "::1:0:0", "255.255.255.255"}
+	for i := 0; i < 300; i++ {
+		queries = append(queries, randomIPv4(), randomIPv6())
+	}
+	for _, item := range tr.Items() {
+		queries = append(queries, item.Prefix.Addr().String())
+	}
+	for _, size := range []int{0, 24, 28, 32} {
+		var buf bytes.Buffer
+		if _, err := tr.WriteMMDB(&buf, MMDBMetadata{RecordSize: size}); err != nil {
+			t.Fatalf("Error on test 14.%d: %v", size, err)
+		}
+		back, meta, err := ReadMMDB(&buf)
+		if err != nil || (size != 0 && meta.RecordSize != size) {
+			t.Fatalf("Error on test 15.%d: %v", size, err)
+		}
+		for _, q := range queries {
+			if a := netip.MustParseAddr(q); a.Is6() && netip.MustParsePrefix("::/96").Contains(a) {
+				continue // there MMDB has IPv4
+			}
+			if fmt.Sprint(back.Get(q)) != fmt.Sprint(tr.Get(q)) {
+				t.Fatalf("Error on test 16.%d: %s is %v, not %v", size, q, back.Get(q), tr.Get(q))
+			}
+		}
+	}
+	four := NewPyTricia()
+	four.Insert("192.0.2.0/24", "doc")
+	buf.Reset()
+	if _, err := four.WriteMMDB(&buf, MMDBMetadata{IPVersion: 4}); err != nil {
+		t.Fatalf("Error on test 17: %v", err)
+	}
+	if back, meta, err := ReadMMDB(&buf); err != nil || meta.IPVersion != 4 || fmt.Sprint(back.Items()) != "[{192.0.2.0/24 doc}]" {
+		t.Errorf("Error on test 18: %v", err)
+	}
+
+	// What MMDB cannot hold is refused.
+	for i, c := range []struct {
+		cidr  string
+		value any
+		meta  MMDBMetadata
+	}{
+		{"::1/128", "loopback", MMDBMetadata{}},
+		{"2001:db8::/32", "doc", MMDBMetadata{IPVersion: 4}},
+		{"10.0.0.0/8", nil, MMDBMetadata{}},
+		{"10.0.0.0/8", struct{}{}, MMDBMetadata{}},
+		{"10.0.0.0/8", int64(1) << 31, MMDBMetadata{}},
+		{"10.0.0.0/8", "ten", MMDBMetadata{RecordSize: 20}},
+		{"10.0.0.0/8", "ten", MMDBMetadata{IPVersion: 5}},
+	} {
+		bad := NewPyTricia()
+		bad.Insert(c.cidr, c.value)
+		if _, err := bad.WriteMMDB(io.Discard, c.meta); err == nil {
+			t.Errorf("Error on test 19.%d: %v accepted", i, c.value)
+		}
+	}
+
+	// Damaged files are refused, and never crash the reader.
+	data, err := os.ReadFile("testdata/fixture-ipv6-28.mmdb")
+	if err != nil {
+		t.Fatalf("Error on test 20: %v", err)
+	}
+	for i := 0; i < len(data); i++ {
+		if _, _, err := ReadMMDB(bytes.NewReader(data[:i])); !errors.Is(err, ErrBadFormat) {
+			t.Fatalf("Error on test 21: cut at %d: %v", i, err)
+		}
+		for _, x := range []byte{0x01, 0x10, 0x80, 0xff} {
+			bad := slices.Clone(data)
+			bad[i] ^= x
+			ReadMMDB(bytes.NewReader(bad))
+		}
+	}
+}
+
+// fixtureMMDB is the content of testdata/written-24.mmdb.
+func fixtureMMDB() *PyTricia {
+	pt := NewPyTricia()
+	pt.Insert("0.0.0.0/0", map[string]any{"name": "default"})
+	pt.Insert("10.0.0.0/8", map[string]any{
+		"u32": uint32(64512), "i32": -5, "f32": float32(1.5), "f64": 2.5, "bool": true,
+		"bytes": []byte{1, 2}, "u128": new(big.Int).Lsh(big.NewInt(1), 100),
+		"list": []any{"x", uint64(1 << 40)}, "long": strings.Repeat("y", 300),
+	})
+	pt.Insert("10.1.0.0/16", map[string]any{"name": "ten-one"})
+	pt.Insert("2001:db8::/32", map[string]any{"name": "doc"})
+	pt.Insert("2001:db8:1::/48", map[string]any{"name": "default"})
+	return pt
+}
+
 func BenchmarkInsertIPv4(b *testing.B) {
 	pt := NewPyTricia()
 	cidrs := []string{}
@@ -190,6 +2459,20 @@ func BenchmarkGetIPv4(b *testing.B) {
 	}
 }
 
+func BenchmarkLookupAddrIPv4(b *testing.B) {
+	pt := NewPyTricia()
+	addrs := []netip.Addr{}
+	for i := 0; i < b.N; i++ {
+		addrs = append(addrs, netip.MustParseAddr(randomIPv4()))
+		pt.Insert(randomIPv4CIDR(), "test")
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pt.LookupAddr(addrs[i])
+	}
+}
+
 func BenchmarkHasKeyIPv4(b *testing.B) {
 	pt := NewPyTricia()
 	cidrs := []string{}
@@ -252,6 +2535,20 @@ func BenchmarkGetIPv6(b *testing.B) {
 	}
 }
 
+func BenchmarkLookupAddrIPv6(b *testing.B) {
+	pt := NewPyTricia()
+	addrs := []netip.Addr{}
+	for i := 0; i < b.N; i++ {
+		addrs = append(addrs, netip.MustParseAddr(randomIPv6()))
+		pt.Insert(randomIPv6CIDR(), "test")
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pt.LookupAddr(addrs[i])
+	}
+}
+
 func BenchmarkHasKeyIPv6(b *testing.B) {
 	pt := NewPyTricia()
 	cidrs := []string{}
@@ -298,3 +2595,114 @@ func BenchmarkAll(b *testing.B) {
 		_ = pt.HasKey(v6cidrs[i])
 	}
 }
+
+// sortedItems returns n random IPv4 /8–/32 prefixes in canonical order.
+func sortedItems(n int) []Item[string] {
+	ref := NewTrie[string]()
+	for len(ref.Keys()) < n {
+		for i := 0; i < n; i++ {
+			ref.Insert(randomIPv4CIDR(), "test")
+		}
+	}
+	return ref.Items()[:n]
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	items := sortedItems(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		BulkLoad(items)
+	}
+}
+
+func BenchmarkUnmarshalBinary(b *testing.B) {
+	tr, _ := BulkLoad(sortedItems(100000))
+	data, _ := tr.MarshalBinary()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewTrie[string]().UnmarshalBinary(data)
+	}
+}
+
+func BenchmarkUnmarshalBinaryRaw(b *testing.B) {
+	tr, _ := BulkLoad(sortedItems(100000), WithCodec[string](stringCodec{}))
+	data, _ := tr.MarshalBinary()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewTrie[string](WithCodec[string](stringCodec{})).UnmarshalBinary(data)
+	}
+}
+
+func BenchmarkMappedGet(b *testing.B) {
+	tr, _ := BulkLoad(sortedItems(100000), WithCodec[string](stringCodec{}))
+	var buf bytes.Buffer
+	tr.WriteMapped(&buf)
+	m, _ := NewMappedTrie[string](buf.Bytes(), WithCodec[string](stringCodec{}))
+	addrs := make([]netip.Addr, 1024)
+	for i := range addrs {
+		addrs[i] = netip.MustParseAddr(randomIPv4())
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.LookupAddr(addrs[i%len(addrs)])
+	}
+}
+
+func BenchmarkBulkInsert(b *testing.B) {
+	items := sortedItems(100000)
+	cidrs := make([]string, len(items))
+	for i, item := range items {
+		cidrs[i] = item.Prefix.String()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pt := NewTrie[string]()
+		for _, cidr := range cidrs {
+			pt.Insert(cidr, "test")
+		}
+	}
+}
+
+// benchmarkMemory reports the live heap retained per stored prefix.
+func benchmarkMemory(b *testing.B, cidrs []string) {
+	var before, after runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		pt := NewPyTricia()
+		for _, cidr := range cidrs {
+			pt.Insert(cidr, "test")
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(len(cidrs)), "B/prefix")
+		runtime.KeepAlive(pt)
+	}
+}
+
+func BenchmarkMemoryIPv4(b *testing.B) {
+	cidrs := make([]string, 100000)
+	for i := range cidrs {
+		cidrs[i] = randomIPv4CIDR()
+	}
+	b.ResetTimer()
+	benchmarkMemory(b, cidrs)
+}
+
+func BenchmarkMemoryIPv6(b *testing.B) {
+	cidrs := make([]string, 100000)
+	for i := range cidrs {
+		cidrs[i] = randomIPv6CIDR()
+	}
+	b.ResetTimer()
+	benchmarkMemory(b, cidrs)
+}
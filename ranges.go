@@ -0,0 +1,196 @@
+package pytricia
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Range is a run of addresses, Start through End inclusive, that all
+// resolve to Value.
+type Range[V any] struct {
+	Start, End netip.Addr
+	Value      V
+}
+
+// InsertRange stores value for every address from start to end
+// inclusive ("1.2.3.4", "1.2.9.17"), as the fewest prefixes that cover
+// exactly that range. They are inserted as one write.
+func (t *Trie[V]) InsertRange(start, end string, value V) error {
+	from, to, err := parseRange(start, end)
+	if err != nil {
+		return err
+	}
+	return t.InsertRangeAddr(from, to, value)
+}
+
+// DeleteRange removes every stored prefix lying inside start..end, as
+// one write. Prefixes only partly inside the range are left alone. A
+// covering prefix the trie's key mode or embedded-IPv4 policies refuse
+// fails the call with its *PrefixError, and nothing is removed.
+func (t *Trie[V]) DeleteRange(start, end string) error {
+	from, to, err := parseRange(start, end)
+	if err != nil {
+		return err
+	}
+	return t.DeleteRangeAddr(from, to)
+}
+
+// InsertRangeAddr: InsertRange for netip.Addr bounds
+func (t *Trie[V]) InsertRangeAddr(start, end netip.Addr, value V) error {
+	prefixes, err := rangePrefixes(start, end)
+	if err != nil {
+		return err
+	}
+	return t.commitAll(func(*tree[V]) []op[V] {
+		ops := make([]op[V], len(prefixes))
+		for i, p := range prefixes {
+			ops[i] = func(tr *tree[V]) (*tree[V], Event[V], error) { return tr.put(p, value, upsert) }
+		}
+		return ops
+	})
+}
+
+// DeleteRangeAddr: DeleteRange for netip.Addr bounds
+func (t *Trie[V]) DeleteRangeAddr(start, end netip.Addr) error {
+	prefixes, err := rangePrefixes(start, end)
+	if err != nil {
+		return err
+	}
+	return t.commitAll(func(cur *tree[V]) []op[V] {
+		var ops []op[V]
+		for _, p := range prefixes {
+			ipType, k, err := cur.resolve(p)
+			if err != nil {
+				return []op[V]{func(*tree[V]) (*tree[V], Event[V], error) { return nil, Event[V]{}, err }}
+			}
+			if s := subtree(cur.root(ipType), k); s != nil {
+				walk(s, func(n *node[V]) bool {
+					stored := n.key.prefix(ipType)
+					ops = append(ops, func(tr *tree[V]) (*tree[V], Event[V], error) { return tr.del(stored) })
+					return true
+				})
+			}
+		}
+		return ops
+	})
+}
+
+// Ranges returns the trie's longest-prefix-match answers as disjoint
+// address ranges in canonical order: every address of a Range resolves
+// to its Value, and addresses resolving to nothing are left out.
+// Neighbouring ranges whose values are equal are merged into one.
+func (t *Trie[V]) Ranges(equal func(a, b V) bool) []Range[V] { return t.load().Ranges(equal) }
+
+// Ranges flattens the trie into ranges; see Trie.Ranges.
+func (tr *tree[V]) Ranges(equal func(a, b V) bool) []Range[V] {
+	out := []Range[V]{}
+	emit := func(start, end netip.Addr, value V) {
+		if !start.IsValid() || end.Less(start) {
+			return
+		}
+		if n := len(out); n > 0 && out[n-1].End.Next() == start && equal(out[n-1].Value, value) {
+			out[n-1].End = end
+			return
+		}
+		out = append(out, Range[V]{Start: start, End: end, Value: value})
+	}
+
+	for _, ipType := range [2]int{4, 6} {
+		// Pre-order visits nested prefixes outermost first, so the ones
+		// still open form a stack; pos is the first address not yet
+		// emitted (invalid once the end of the family is reached).
+		type open struct {
+			end   netip.Addr
+			value V
+		}
+		var stack []open
+		var pos netip.Addr
+		closeUntil := func(start netip.Addr) {
+			for len(stack) > 0 && (!start.IsValid() || stack[len(stack)-1].end.Less(start)) {
+				top := stack[len(stack)-1]
+				emit(pos, top.end, top.value)
+				pos, stack = top.end.Next(), stack[:len(stack)-1]
+			}
+		}
+		walk(tr.root(ipType), func(n *node[V]) bool {
+			p := n.key.prefix(ipType)
+			closeUntil(p.Addr())
+			if len(stack) > 0 {
+				emit(pos, p.Addr().Prev(), stack[len(stack)-1].value)
+			}
+			stack = append(stack, open{end: lastAddr(p), value: n.value})
+			pos = p.Addr()
+			return true
+		})
+		closeUntil(netip.Addr{})
+	}
+	return out
+}
+
+// parseRange parses the bounds of a range given as strings.
+func parseRange(start, end string) (netip.Addr, netip.Addr, error) {
+	from, err := parseAddr(start)
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, err
+	}
+	to, err := parseAddr(end)
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, err
+	}
+	return from, to, nil
+}
+
+// parseAddr is parseCIDR for a lone address: a mask is refused.
+func parseAddr(s string) (netip.Addr, error) {
+	if i := strings.LastIndexByte(s, '/'); i >= 0 {
+		return netip.Addr{}, &PrefixError{Input: s, Pos: i, Reason: ReasonBadMask}
+	}
+	p, err := parseCIDR(s)
+	return p.Addr(), err
+}
+
+// rangePrefixes splits start..end into the fewest prefixes covering it
+// exactly, in order.
+func rangePrefixes(start, end netip.Addr) ([]netip.Prefix, error) {
+	for _, a := range [2]netip.Addr{start, end} {
+		if err := checkPrefix(netip.PrefixFrom(a, a.BitLen())); err != nil {
+			return nil, err
+		}
+	}
+	start, end = start.WithZone(""), end.WithZone("")
+	if start.Is4() != end.Is4() || end.Less(start) {
+		return nil, fmt.Errorf("%w: %v-%v", ErrInvalidRange, start, end)
+	}
+
+	var out []netip.Prefix
+	for start.IsValid() && !end.Less(start) {
+		// The shortest prefix that starts at start and stays within end.
+		for bits := 0; bits <= start.BitLen(); bits++ {
+			p := netip.PrefixFrom(start, bits)
+			if p.Masked().Addr() == start && !end.Less(lastAddr(p)) {
+				out = append(out, p)
+				start = lastAddr(p).Next()
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// lastAddr returns the highest address inside p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().As16()
+	bits := p.Bits()
+	if p.Addr().Is4() {
+		bits += 96
+	}
+	for i := bits; i < 128; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	a := netip.AddrFrom16(b)
+	if p.Addr().Is4() {
+		return a.Unmap()
+	}
+	return a
+}
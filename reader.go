@@ -0,0 +1,45 @@
+package pytricia
+
+import "net/netip"
+
+// Reader is the lookup API shared by Trie, Snapshot and MappedTrie, so
+// code written against it works with whichever the caller constructs.
+type Reader[V any] interface {
+	Get(cidr string) (V, bool)
+	GetKey(cidr string) string
+	GetKV(cidr string) (string, V, bool)
+	Contains(cidr string) bool
+	HasKey(cidr string) bool
+	GetAll(cidr string) []Item[V]
+	GetPrefix(p netip.Prefix) (V, bool)
+	LookupPrefix(p netip.Prefix) (key netip.Prefix, value V, ok bool)
+	LookupAddr(a netip.Addr) (key netip.Prefix, value V, ok bool)
+	ContainsAddr(a netip.Addr) bool
+	HasPrefix(p netip.Prefix) bool
+	Covering(p netip.Prefix) []Item[V]
+}
+
+// PyReader is Reader as PyTricia and MappedPyTricia offer it, missing
+// entries reading as nil values.
+type PyReader interface {
+	Get(cidr string) interface{}
+	GetKey(cidr string) string
+	GetKV(cidr string) (string, interface{})
+	Contains(cidr string) bool
+	HasKey(cidr string) bool
+	GetAll(cidr string) []Item[any]
+	GetPrefix(p netip.Prefix) interface{}
+	LookupPrefix(p netip.Prefix) (key netip.Prefix, value any, ok bool)
+	LookupAddr(a netip.Addr) (key netip.Prefix, value any, ok bool)
+	ContainsAddr(a netip.Addr) bool
+	HasPrefix(p netip.Prefix) bool
+	Covering(p netip.Prefix) []Item[any]
+}
+
+var (
+	_ Reader[any] = (*Trie[any])(nil)
+	_ Reader[any] = Snapshot[any]{}
+	_ Reader[any] = (*MappedTrie[any])(nil)
+	_ PyReader    = (*PyTricia)(nil)
+	_ PyReader    = (*MappedPyTricia)(nil)
+)
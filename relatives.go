@@ -1,58 +1,186 @@
 package pytricia
 
-// Children returns every descendant whose value is non-nil.
-// Snapshot semantics: may miss nodes added *after* the initial lock.
-func (t *PyTricia) Children(cidr string) map[string]interface{} {
-	out := make(map[string]interface{})
-
-	// 1) Locate the subtree root under a short read-lock.
-	t.mutex.RLock()
-	start := t.getNode(cidr)
-	t.mutex.RUnlock()
-	if start == nil {
+import "net/netip"
+
+// Children returns every stored descendant of the longest match. The
+// map is unordered; ChildrenSorted returns the same entries in order.
+func (t *Trie[V]) Children(cidr string) map[string]V { return t.load().Children(cidr) }
+
+// ChildrenSorted: Children as a slice in canonical order.
+func (t *Trie[V]) ChildrenSorted(cidr string) []Item[V] { return t.load().ChildrenSorted(cidr) }
+
+// Parent returns the closest valued ancestor of the longest match.
+func (t *Trie[V]) Parent(cidr string) (string, V, bool) { return t.load().Parent(cidr) }
+
+// GetAll returns every stored prefix covering cidr, most specific first:
+// the longest match, its parent, that one's parent and so on.
+func (t *Trie[V]) GetAll(cidr string) []Item[V] { return t.load().GetAll(cidr) }
+
+// ChildrenPrefix: Children for a netip.Prefix
+func (t *Trie[V]) ChildrenPrefix(p netip.Prefix) map[netip.Prefix]V {
+	return t.load().ChildrenPrefix(p)
+}
+
+// ChildrenPrefixSorted: ChildrenPrefix as a slice in canonical order.
+func (t *Trie[V]) ChildrenPrefixSorted(p netip.Prefix) []Item[V] {
+	return t.load().ChildrenPrefixSorted(p)
+}
+
+// Covering: GetAll for a netip.Prefix.
+func (t *Trie[V]) Covering(p netip.Prefix) []Item[V] { return t.load().Covering(p) }
+
+// CoveredBy returns every stored prefix contained within p, in canonical
+// order; p itself is included only when inclusive is set. Unlike
+// Children it needs no stored match for p, and never strays outside it.
+func (t *Trie[V]) CoveredBy(p netip.Prefix, inclusive bool) []Item[V] {
+	return t.load().CoveredBy(p, inclusive)
+}
+
+// ParentPrefix: Parent for a netip.Prefix; ok is false without a parent
+func (t *Trie[V]) ParentPrefix(p netip.Prefix) (key netip.Prefix, value V, ok bool) {
+	return t.load().ParentPrefix(p)
+}
+
+// Parent returns the closest valued ancestor of the longest match.
+func (t *PyTricia) Parent(cidr string) (string, interface{}) {
+	key, value, _ := t.Trie.Parent(cidr)
+	return key, value
+}
+
+// Children returns every stored descendant of the longest match. The
+// map is unordered; ChildrenSorted returns the same entries in order.
+func (tr *tree[V]) Children(cidr string) map[string]V {
+	out := make(map[string]V)
+	p, err := parseCIDR(cidr)
+	if err != nil {
 		return out
 	}
+	for key, value := range tr.ChildrenPrefix(p) {
+		out[key.String()] = value
+	}
+	return out
+}
 
-	// 2) Depth-first scan without holding the global lock.
-	stack := []*PyTricia{start}
-	for len(stack) > 0 {
-		n := stack[len(stack)-1]
-		stack = stack[:len(stack)-1]
+// ChildrenSorted: Children as a slice in canonical order.
+func (tr *tree[V]) ChildrenSorted(cidr string) []Item[V] {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		return []Item[V]{}
+	}
+	return tr.ChildrenPrefixSorted(p)
+}
 
-		if v := n.value; v != nil {
-			if c := n.cidr(); c != nil {
-				out[c.String()] = v
-			}
-		}
-		if r := n.children[1]; r != nil {
-			stack = append(stack, r)
-		}
-		if l := n.children[0]; l != nil {
-			stack = append(stack, l)
+// Parent returns the closest valued ancestor of the longest match.
+func (tr *tree[V]) Parent(cidr string) (string, V, bool) {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		var zero V
+		return "", zero, false
+	}
+	key, value, ok := tr.ParentPrefix(p)
+	if !ok {
+		return "", value, false
+	}
+	return key.String(), value, true
+}
+
+// GetAll returns every stored prefix covering cidr, most specific first:
+// the longest match, its parent, that one's parent and so on.
+func (tr *tree[V]) GetAll(cidr string) []Item[V] {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		return []Item[V]{}
+	}
+	return tr.Covering(p)
+}
+
+// ChildrenPrefix: Children for a netip.Prefix
+func (tr *tree[V]) ChildrenPrefix(p netip.Prefix) map[netip.Prefix]V {
+	out := make(map[netip.Prefix]V)
+	for _, item := range tr.ChildrenPrefixSorted(p) {
+		out[item.Prefix] = item.Value
+	}
+	return out
+}
+
+// ChildrenPrefixSorted: ChildrenPrefix as a slice in canonical order.
+func (tr *tree[V]) ChildrenPrefixSorted(p netip.Prefix) []Item[V] {
+	out := []Item[V]{}
+	ipType, k, err := tr.resolve(p)
+	if err != nil {
+		return out
+	}
+
+	// Scan the subtree below the longest match.
+	if start := longest(tr.root(ipType), k); start != nil {
+		walk(start, func(n *node[V]) bool {
+			out = append(out, Item[V]{Prefix: n.cidr(ipType), Value: n.value})
+			return true
+		})
+	}
+	return out
+}
+
+// Covering: GetAll for a netip.Prefix. The whole chain comes from one
+// walk of one version, so it is consistent even with writers about.
+func (tr *tree[V]) Covering(p netip.Prefix) []Item[V] {
+	out := []Item[V]{}
+	ipType, k, err := tr.resolve(p)
+	if err != nil {
+		return out
+	}
+
+	for n := tr.root(ipType); n != nil && n.key.contains(k); n = n.child(k) {
+		if n.set {
+			out = append(out, Item[V]{Prefix: n.cidr(ipType), Value: n.value})
 		}
 	}
+
+	// The walk runs root-down; flip it to most specific first.
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
 	return out
 }
 
-// Parent returns the first ancestor that carries a non-nil value.
-// Snapshot semantics: if another goroutine inserts a closer ancestor
-// concurrently you may still see the older one, but never an invalid ptr.
-func (t *PyTricia) Parent(cidr string) (string, interface{}) {
-	// 1) Pin the start node quickly under read-lock.
-	t.mutex.RLock()
-	n := t.getNode(cidr)
-	t.mutex.RUnlock()
-	if n == nil {
-		return "", nil
-	}
-
-	// 2) Walk upward lock-free.
-	for p := n.parent; p != nil; p = p.parent {
-		if v := p.value; v != nil {
-			if c := p.cidr(); c != nil {
-				return c.String(), v
+// CoveredBy returns every stored prefix contained within p, in canonical
+// order; p itself is included only when inclusive is set. Unlike
+// Children it needs no stored match for p, and never strays outside it.
+func (tr *tree[V]) CoveredBy(p netip.Prefix, inclusive bool) []Item[V] {
+	out := []Item[V]{}
+	ipType, k, err := tr.resolve(p)
+	if err != nil {
+		return out
+	}
+
+	if start := subtree(tr.root(ipType), k); start != nil {
+		walk(start, func(n *node[V]) bool {
+			if inclusive || n.key != k {
+				out = append(out, Item[V]{Prefix: n.cidr(ipType), Value: n.value})
 			}
+			return true
+		})
+	}
+	return out
+}
+
+// ParentPrefix: Parent for a netip.Prefix; ok is false without a parent
+func (tr *tree[V]) ParentPrefix(p netip.Prefix) (key netip.Prefix, value V, ok bool) {
+	ipType, k, err := tr.resolve(p)
+	if err != nil {
+		return netip.Prefix{}, value, false
+	}
+
+	// Walk down the family subtree; the valued node seen just before the
+	// longest match is its parent.
+	var best, parent *node[V]
+	for n := tr.root(ipType); n != nil && n.key.contains(k); n = n.child(k) {
+		if n.set {
+			best, parent = n, best
 		}
 	}
-	return "", nil
+	if best == nil || parent == nil {
+		return netip.Prefix{}, value, false
+	}
+	return parent.cidr(ipType), parent.value, true
 }
@@ -0,0 +1,188 @@
+package pytricia
+
+import (
+	"iter"
+	"slices"
+)
+
+// Set operations read a nil trie as an empty one.
+
+// Union returns a new trie holding every prefix of t and of other. A
+// prefix stored in both gets merge(t's value, other's value).
+func (t *Trie[V]) Union(other *Trie[V], merge func(a, b V) V) *Trie[V] {
+	a, b := t.load(), other.load()
+	return a.combine(b, func(ipType int, x, y *node[V], add func(*node[V], V)) {
+		switch {
+		case y == nil:
+			add(x, x.value)
+		case x == nil:
+			add(y, y.value)
+		default:
+			add(x, merge(x.value, y.value))
+		}
+	})
+}
+
+// Intersect returns a new trie covering just the address space both
+// tries cover: every prefix of either trie that the other one covers,
+// valued merge(t's longest match, other's longest match). A lookup in
+// the result finds merge(t's answer, other's answer) wherever both have
+// one, and nothing elsewhere.
+func (t *Trie[V]) Intersect(other *Trie[V], merge func(a, b V) V) *Trie[V] {
+	a, b := t.load(), other.load()
+	return a.combine(b, func(ipType int, x, y *node[V], add func(*node[V], V)) {
+		switch {
+		case y == nil:
+			if m := longest(b.root(ipType), x.key); m != nil {
+				add(x, merge(x.value, m.value))
+			}
+		case x == nil:
+			if m := longest(a.root(ipType), y.key); m != nil {
+				add(y, merge(m.value, y.value))
+			}
+		default:
+			add(x, merge(x.value, y.value))
+		}
+	})
+}
+
+// Subtract returns a new trie covering the address space of t minus all
+// of other's. Prefixes of t inside other are dropped, and those that
+// only partly overlap it are split into the exact remainder: 10.0.0.0/8
+// minus 10.1.0.0/16 leaves 10.0.0.0/16, 10.2.0.0/15, ... 10.128.0.0/9,
+// each with 10.0.0.0/8's value.
+func (t *Trie[V]) Subtract(other *Trie[V]) *Trie[V] {
+	a, b := t.load(), other.load()
+	next := &tree[V]{cfg: a.cfg}
+	for _, ipType := range [2]int{4, 6} {
+		var out []*node[V]
+		bRoot := b.root(ipType)
+		walk(a.root(ipType), func(x *node[V]) bool {
+			if longest(bRoot, x.key) != nil {
+				return true
+			}
+			if s := subtree(bRoot, x.key); s == nil {
+				out = append(out, x)
+			} else {
+				free(x.key, s, func(k key) bool {
+					out = append(out, &node[V]{key: k, value: x.value, set: true})
+					return true
+				})
+			}
+			return true
+		})
+
+		// Fragments interleave with t's own more specific prefixes, and
+		// may coincide with one, which then wins.
+		slices.SortStableFunc(out, func(x, y *node[V]) int {
+			switch {
+			case keyLess(x.key, y.key):
+				return -1
+			case keyLess(y.key, x.key):
+				return 1
+			}
+			return 0
+		})
+		bld := newBuilder[V]()
+		for i, n := range out {
+			if i+1 < len(out) && out[i+1].key == n.key {
+				continue
+			}
+			bld.add(n.key, n.value).orig = n.orig
+		}
+		next.set(ipType, bld.root)
+	}
+	tr := &Trie[V]{}
+	tr.root.Store(next)
+	return tr
+}
+
+// Union: Trie.Union between PyTricias, returning a PyTricia.
+func (t *PyTricia) Union(other *PyTricia, merge func(a, b any) any) *PyTricia {
+	return pyTricia(t.trie().Union(other.trie(), merge))
+}
+
+// Intersect: Trie.Intersect between PyTricias, returning a PyTricia.
+func (t *PyTricia) Intersect(other *PyTricia, merge func(a, b any) any) *PyTricia {
+	return pyTricia(t.trie().Intersect(other.trie(), merge))
+}
+
+// Subtract: Trie.Subtract between PyTricias, returning a PyTricia.
+func (t *PyTricia) Subtract(other *PyTricia) *PyTricia {
+	return pyTricia(t.trie().Subtract(other.trie()))
+}
+
+// combine builds a new version from a and b, walked in lockstep: pick
+// is called for every prefix in either, in canonical order, with the
+// node of a and of b holding it (one of them nil when only the other
+// has it), and keeps what it passes to add.
+func (a *tree[V]) combine(b *tree[V], pick func(ipType int, x, y *node[V], add func(*node[V], V))) *Trie[V] {
+	next := &tree[V]{cfg: a.cfg}
+	for _, ipType := range [2]int{4, 6} {
+		bld := newBuilder[V]()
+		add := func(n *node[V], value V) { bld.add(n.key, value).orig = n.orig }
+		lockstep(a.root(ipType), b.root(ipType), func(x, y *node[V]) {
+			pick(ipType, x, y, add)
+		})
+		next.set(ipType, bld.root)
+	}
+	t := &Trie[V]{}
+	t.root.Store(next)
+	return t
+}
+
+// lockstep walks the valued nodes of two subtrees of the same family
+// together in canonical order, calling visit once per prefix with its
+// node in each (nil where a subtree lacks it).
+func lockstep[V any](a, b *node[V], visit func(x, y *node[V])) {
+	nextA, stopA := iter.Pull(nodes(a))
+	defer stopA()
+	nextB, stopB := iter.Pull(nodes(b))
+	defer stopB()
+
+	x, okA := nextA()
+	y, okB := nextB()
+	for okA || okB {
+		switch {
+		case !okB || okA && keyLess(x.key, y.key):
+			visit(x, nil)
+			x, okA = nextA()
+		case !okA || keyLess(y.key, x.key):
+			visit(nil, y)
+			y, okB = nextB()
+		default:
+			visit(x, y)
+			x, okA = nextA()
+			y, okB = nextB()
+		}
+	}
+}
+
+// nodes iterates over the valued nodes below n in canonical order.
+func nodes[V any](n *node[V]) iter.Seq[*node[V]] {
+	return func(yield func(*node[V]) bool) { walk(n, yield) }
+}
+
+// free calls emit, in canonical order, for every maximal prefix inside
+// k that holds no valued node, stopping early once emit returns false.
+// n is the topmost node inside k (see subtree), or nil if there is none.
+func free[V any](k key, n *node[V], emit func(key) bool) bool {
+	switch {
+	case n == nil:
+		return emit(k)
+	case n.key == k:
+		if n.set {
+			return true
+		}
+		if n.children[0] == nil && n.children[1] == nil {
+			return emit(k) // an empty family root
+		}
+		return free(k.extend(0), n.children[0], emit) && free(k.extend(1), n.children[1], emit)
+	}
+
+	// n sits further down one half; the other half is empty.
+	if n.key.bit(int(k.plen)) == 0 {
+		return free(k.extend(0), n, emit) && emit(k.extend(1))
+	}
+	return emit(k.extend(0)) && free(k.extend(1), n, emit)
+}
@@ -1,138 +1,176 @@
 package pytricia
 
-import "errors"
+import (
+	"fmt"
+	"net/netip"
+)
+
+// writeMode selects the presence check a write applies.
+type writeMode int
+
+const (
+	upsert writeMode = iota // Insert: overwrite or create
+	create                  // Add: only if not yet present
+	update                  // Set: only if already present
+)
 
 // Insert: overwrite or create
-func (t *PyTricia) Insert(cidr string, value interface{}) error {
-	ip, ones, err := parseCIDR(cidr)
+func (t *Trie[V]) Insert(cidr string, value V) error {
+	p, err := parseCIDR(cidr)
 	if err != nil {
 		return err
 	}
+	return t.InsertPrefix(p, value)
+}
 
-	node := t
-	i := 0
-
-	// 1) Walk under read-lock until we hit a nil edge
-	t.mutex.RLock()
-	for ; i < ones; i++ {
-		b := bit(ip, i)
-		if next := node.children[b]; next != nil {
-			node = next
-			continue
-		}
-		break
+// Set: overwrite only if CIDR already present
+func (t *Trie[V]) Set(cidr string, value V) error {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		return err
 	}
-	t.mutex.RUnlock()
-
-	// 2) If we stopped early, grab the write-lock once and finish path
-	if i < ones {
-		t.mutex.Lock()
-		for ; i < ones; i++ {
-			b := bit(ip, i)
-			if node.children[b] == nil { // **double-check after lock**
-				node.children[b] = &PyTricia{
-					parent:   node,
-					children: [2]*PyTricia{},
-					value:    nil,
-					ipType:   typeIP(cidr),
-				}
-			}
-			node = node.children[b]
-		}
-		// still holding write-lock → set value
-		node.value = value
-		node.ipType = typeIP(cidr)
-		t.mutex.Unlock()
-		return nil
+	return t.SetPrefix(p, value)
+}
+
+// Add: insert only if CIDR *not* already present
+func (t *Trie[V]) Add(cidr string, value V) error {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		return err
 	}
+	return t.AddPrefix(p, value)
+}
 
-	// 3) Path existed; just update value (very short write-lock)
-	t.mutex.Lock()
-	node.value = value
-	node.ipType = typeIP(cidr)
-	t.mutex.Unlock()
-	return nil
+// InsertPrefix: Insert for a netip.Prefix (host bits as per the KeyMode)
+func (t *Trie[V]) InsertPrefix(p netip.Prefix, value V) error {
+	return t.commit(func(tr *tree[V]) (*tree[V], Event[V], error) { return tr.put(p, value, upsert) })
 }
 
-// Set: overwrite only if CIDR already present
-func (t *PyTricia) Set(cidr string, value interface{}) error {
-	ip, ones, err := parseCIDR(cidr)
+// SetPrefix: Set for a netip.Prefix
+func (t *Trie[V]) SetPrefix(p netip.Prefix, value V) error {
+	return t.commit(func(tr *tree[V]) (*tree[V], Event[V], error) { return tr.put(p, value, update) })
+}
+
+// AddPrefix: Add for a netip.Prefix
+func (t *Trie[V]) AddPrefix(p netip.Prefix, value V) error {
+	return t.commit(func(tr *tree[V]) (*tree[V], Event[V], error) { return tr.put(p, value, create) })
+}
+
+// op is one write against a version: it returns the new version and
+// the change it made, leaving the version it was given untouched.
+type op[V any] func(*tree[V]) (*tree[V], Event[V], error)
+
+// commit runs o against the current version under the writer lock,
+// publishes the version it returns and notifies subscribers; on error
+// nothing is published.
+func (t *Trie[V]) commit(o op[V]) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	next, ev, err := o(t.load())
 	if err != nil {
 		return err
 	}
+	t.root.Store(next)
+	t.notify(ev)
+	return nil
+}
 
-	node := t
-	t.mutex.RLock()
-	for i := 0; i < ones; i++ {
-		b := bit(ip, i)
-		if node = node.children[b]; node == nil {
-			t.mutex.RUnlock()
-			return errors.New("CIDR not present")
+// commitAll is commit for a batch: plan lists the ops against the
+// current version, and they are published together or not at all.
+func (t *Trie[V]) commitAll(plan func(*tree[V]) []op[V]) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	cur := t.load()
+	ops := plan(cur)
+	events := make([]Event[V], 0, len(ops))
+	for _, o := range ops {
+		var (
+			ev  Event[V]
+			err error
+		)
+		if cur, ev, err = o(cur); err != nil {
+			return err
 		}
+		events = append(events, ev)
 	}
-	if node.value == nil {
-		t.mutex.RUnlock()
-		return errors.New("CIDR not present")
+	t.root.Store(cur)
+	for _, ev := range events {
+		t.notify(ev)
 	}
-	t.mutex.RUnlock()
-
-	// value exists → acquire write-lock just to mutate
-	t.mutex.Lock()
-	node.value = value
-	node.ipType = typeIP(cidr)
-	t.mutex.Unlock()
 	return nil
 }
 
-// Add: insert only if CIDR *not* already present
-func (t *PyTricia) Add(cidr string, value interface{}) error {
-	ip, ones, err := parseCIDR(cidr)
+// put returns a new version with p mapped to value, after checking p's
+// presence as mode demands. tr itself is never modified.
+func (tr *tree[V]) put(p netip.Prefix, value V, mode writeMode) (*tree[V], Event[V], error) {
+	var ev Event[V]
+	ipType, k, err := tr.resolve(p)
 	if err != nil {
-		return err
+		return nil, ev, err
 	}
 
-	node := t
-	i := 0
-
-	// 1) Read-only walk until gap or end
-	t.mutex.RLock()
-	for ; i < ones; i++ {
-		b := bit(ip, i)
-		if next := node.children[b]; next != nil {
-			node = next
-			continue
+	if mode != upsert {
+		n := find(tr.root(ipType), k)
+		if present := n != nil && n.set; mode == create && present {
+			return nil, ev, fmt.Errorf("%w: %v", ErrExists, k.prefix(ipType))
+		} else if mode == update && !present {
+			return nil, ev, fmt.Errorf("%w: %v", ErrNotFound, k.prefix(ipType))
 		}
-		break
 	}
-	alreadyExists := (i == ones && node.value != nil)
-	t.mutex.RUnlock()
+	root, n := place(tr.root(ipType), k)
 
-	if alreadyExists {
-		return errors.New("CIDR already present")
+	// n is a private copy, still carrying whatever value it had before.
+	ev = Event[V]{Kind: Added, Value: value}
+	if n.set {
+		ev.Kind, ev.Old = Replaced, n.value
 	}
+	n.store(value)
+	n.orig = tr.original(p)
+	ev.Prefix = n.cidr(ipType)
+	return tr.with(ipType, root), ev, nil
+}
 
-	// 2) Need to create nodes or set value → single write-lock
-	t.mutex.Lock()
-	// (re-do the walk from the point we left off; node is still correct)
-	for ; i < ones; i++ {
-		b := bit(ip, i)
-		if node.children[b] == nil {
-			node.children[b] = &PyTricia{
-				parent:   node,
-				children: [2]*PyTricia{},
-				value:    nil,
-				ipType:   typeIP(cidr),
-			}
+// place copies the path from root down to k, splicing in a node for k –
+// plus a branch node where k leaves an existing edge part-way – when
+// none exists yet. It returns the new root and k's node, both private
+// to the caller until published; the old version is left untouched.
+func place[V any](root *node[V], k key) (*node[V], *node[V]) {
+	newRoot := root.clone()
+	n := newRoot
+	for {
+		// invariant: n.key contains k, and n is a private copy
+		if n.key.plen == k.plen {
+			return newRoot, n
+		}
+		b := k.bit(int(n.key.plen))
+		c := n.children[b]
+		if c == nil {
+			c = &node[V]{key: k}
+			n.children[b] = c
+			return newRoot, c
 		}
-		node = node.children[b]
-	}
 
-	if node.value != nil { // in case another writer beat us
-		t.mutex.Unlock()
-		return errors.New("CIDR already present")
+		common := c.key.commonLen(k)
+		if common == int(c.key.plen) {
+			c = c.clone()
+			n.children[b] = c
+			n = c
+			continue
+		}
+
+		leaf := &node[V]{key: k}
+		if common == int(k.plen) {
+			// k sits on the edge above c: slot it in between.
+			leaf.children[c.key.bit(common)] = c
+			n.children[b] = leaf
+			return newRoot, leaf
+		}
+
+		// k and c diverge inside the edge: fork it with a branch node.
+		branch := &node[V]{key: k.truncate(common)}
+		branch.children[c.key.bit(common)] = c
+		branch.children[k.bit(common)] = leaf
+		n.children[b] = branch
+		return newRoot, leaf
 	}
-	node.value = value
-	node.ipType = typeIP(cidr)
-	t.mutex.Unlock()
-	return nil
 }
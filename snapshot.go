@@ -0,0 +1,167 @@
+package pytricia
+
+import (
+	"io"
+	"iter"
+	"net/netip"
+)
+
+// Snapshot is a read-only view of a Trie frozen at the moment Snapshot
+// was called. It shares every node with the live trie – later writes
+// copy what they change instead of touching it – so taking one is O(1)
+// and allocation-free, and it stays valid and unchanged for as long as
+// it is held, whatever Insert/Delete traffic the trie sees meanwhile.
+//
+// Snapshot offers the full read API of Trie (Get, LookupAddr, Children,
+// Covering, CoveredBy, All, Items, ...) with identical semantics, its
+// methods in the same order. The zero Snapshot reads as an empty trie,
+// as the zero Trie does.
+type Snapshot[V any] struct {
+	tr *tree[V]
+}
+
+// Snapshot returns a point-in-time, read-only view of the trie.
+func (t *Trie[V]) Snapshot() Snapshot[V] {
+	return Snapshot[V]{t.load()}
+}
+
+// load returns the frozen version; a zero Snapshot reads as empty.
+func (s Snapshot[V]) load() *tree[V] {
+	if s.tr != nil {
+		return s.tr
+	}
+	return newTree[V](defaults)
+}
+
+// Get: see Trie.Get.
+func (s Snapshot[V]) Get(cidr string) (V, bool) { return s.load().Get(cidr) }
+
+// GetKey: see Trie.GetKey.
+func (s Snapshot[V]) GetKey(cidr string) string { return s.load().GetKey(cidr) }
+
+// GetKV: see Trie.GetKV.
+func (s Snapshot[V]) GetKV(cidr string) (string, V, bool) { return s.load().GetKV(cidr) }
+
+// Contains: see Trie.Contains.
+func (s Snapshot[V]) Contains(cidr string) bool { return s.load().Contains(cidr) }
+
+// HasKey: see Trie.HasKey.
+func (s Snapshot[V]) HasKey(cidr string) bool { return s.load().HasKey(cidr) }
+
+// GetPrefix: see Trie.GetPrefix.
+func (s Snapshot[V]) GetPrefix(p netip.Prefix) (V, bool) { return s.load().GetPrefix(p) }
+
+// LookupPrefix: see Trie.LookupPrefix.
+func (s Snapshot[V]) LookupPrefix(p netip.Prefix) (key netip.Prefix, value V, ok bool) {
+	return s.load().LookupPrefix(p)
+}
+
+// LookupAddr: see Trie.LookupAddr.
+func (s Snapshot[V]) LookupAddr(a netip.Addr) (key netip.Prefix, value V, ok bool) {
+	return s.load().LookupAddr(a)
+}
+
+// ContainsAddr: see Trie.ContainsAddr.
+func (s Snapshot[V]) ContainsAddr(a netip.Addr) bool { return s.load().ContainsAddr(a) }
+
+// HasPrefix: see Trie.HasPrefix.
+func (s Snapshot[V]) HasPrefix(p netip.Prefix) bool { return s.load().HasPrefix(p) }
+
+// Children: see Trie.Children.
+func (s Snapshot[V]) Children(cidr string) map[string]V { return s.load().Children(cidr) }
+
+// ChildrenSorted: see Trie.ChildrenSorted.
+func (s Snapshot[V]) ChildrenSorted(cidr string) []Item[V] { return s.load().ChildrenSorted(cidr) }
+
+// Parent: see Trie.Parent.
+func (s Snapshot[V]) Parent(cidr string) (string, V, bool) { return s.load().Parent(cidr) }
+
+// GetAll: see Trie.GetAll.
+func (s Snapshot[V]) GetAll(cidr string) []Item[V] { return s.load().GetAll(cidr) }
+
+// ChildrenPrefix: see Trie.ChildrenPrefix.
+func (s Snapshot[V]) ChildrenPrefix(p netip.Prefix) map[netip.Prefix]V {
+	return s.load().ChildrenPrefix(p)
+}
+
+// ChildrenPrefixSorted: see Trie.ChildrenPrefixSorted.
+func (s Snapshot[V]) ChildrenPrefixSorted(p netip.Prefix) []Item[V] {
+	return s.load().ChildrenPrefixSorted(p)
+}
+
+// Covering: see Trie.Covering.
+func (s Snapshot[V]) Covering(p netip.Prefix) []Item[V] { return s.load().Covering(p) }
+
+// CoveredBy: see Trie.CoveredBy.
+func (s Snapshot[V]) CoveredBy(p netip.Prefix, inclusive bool) []Item[V] {
+	return s.load().CoveredBy(p, inclusive)
+}
+
+// ParentPrefix: see Trie.ParentPrefix.
+func (s Snapshot[V]) ParentPrefix(p netip.Prefix) (key netip.Prefix, value V, ok bool) {
+	return s.load().ParentPrefix(p)
+}
+
+// ToMap: see Trie.ToMap.
+func (s Snapshot[V]) ToMap() map[netip.Prefix]V { return s.load().ToMap() }
+
+// Keys: see Trie.Keys.
+func (s Snapshot[V]) Keys() []string { return s.load().Keys() }
+
+// Values: see Trie.Values.
+func (s Snapshot[V]) Values() []V { return s.load().Values() }
+
+// Items: see Trie.Items.
+func (s Snapshot[V]) Items() []Item[V] { return s.load().Items() }
+
+// All: see Trie.All.
+func (s Snapshot[V]) All() iter.Seq2[netip.Prefix, V] { return s.load().All() }
+
+// Prefixes: see Trie.Prefixes.
+func (s Snapshot[V]) Prefixes() iter.Seq[netip.Prefix] { return s.load().Prefixes() }
+
+// Descendants: see Trie.Descendants.
+func (s Snapshot[V]) Descendants(p netip.Prefix) iter.Seq2[netip.Prefix, V] {
+	return s.load().Descendants(p)
+}
+
+// Ancestors: see Trie.Ancestors.
+func (s Snapshot[V]) Ancestors(p netip.Prefix) iter.Seq2[netip.Prefix, V] {
+	return s.load().Ancestors(p)
+}
+
+// Aggregate: see Trie.Aggregate.
+func (s Snapshot[V]) Aggregate(equal func(a, b V) bool) *Trie[V] {
+	return s.load().Aggregate(equal)
+}
+
+// Gaps: see Trie.Gaps.
+func (s Snapshot[V]) Gaps(within netip.Prefix) []netip.Prefix { return s.load().Gaps(within) }
+
+// AllocateFree: see Trie.AllocateFree.
+func (s Snapshot[V]) AllocateFree(within netip.Prefix, length int) (netip.Prefix, error) {
+	return s.load().AllocateFree(within, length)
+}
+
+// Ranges: see Trie.Ranges.
+func (s Snapshot[V]) Ranges(equal func(a, b V) bool) []Range[V] { return s.load().Ranges(equal) }
+
+// MarshalBinary: see Trie.MarshalBinary.
+func (s Snapshot[V]) MarshalBinary() ([]byte, error) { return s.load().MarshalBinary() }
+
+// WriteTo: see Trie.WriteTo.
+func (s Snapshot[V]) WriteTo(w io.Writer) (int64, error) { return s.load().WriteTo(w) }
+
+// MarshalJSON: see Trie.MarshalJSON.
+func (s Snapshot[V]) MarshalJSON() ([]byte, error) { return s.load().MarshalJSON() }
+
+// MarshalText: see Trie.MarshalText.
+func (s Snapshot[V]) MarshalText() ([]byte, error) { return s.load().MarshalText() }
+
+// WriteMapped: see Trie.WriteMapped.
+func (s Snapshot[V]) WriteMapped(w io.Writer) (int64, error) { return s.load().WriteMapped(w) }
+
+// WriteMMDB: see Trie.WriteMMDB.
+func (s Snapshot[V]) WriteMMDB(w io.Writer, meta MMDBMetadata) (int64, error) {
+	return s.load().WriteMMDB(w, meta)
+}
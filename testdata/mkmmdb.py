@@ -0,0 +1,227 @@
+#!/usr/bin/env python3
+"""Writes the MaxMind DB fixtures read by TestMMDB.
+
+They are built here, apart from the Go writer, and use what it does not:
+28- and 32-bit records, pointers, aliases of the IPv4 subtree and every
+data type. Run from the repository root: python3 testdata/mkmmdb.py
+"""
+
+import ipaddress
+import struct
+
+MARKER = b"\xab\xcd\xefMaxMind.com"
+
+
+class Ptr:
+    """A pointer to data already written at off."""
+
+    def __init__(self, off):
+        self.off = off
+
+
+class U16(int): pass
+class U32(int): pass
+class U64(int): pass
+class U128(int): pass
+class I32(int): pass
+class F32(float): pass
+
+
+def ctrl(typ, size):
+    if size < 29:
+        extra, size_bits = b"", size
+    elif size < 285:
+        extra, size_bits = bytes([size - 29]), 29
+    elif size < 65821:
+        extra, size_bits = struct.pack(">H", size - 285), 30
+    else:
+        extra, size_bits = (size - 65821).to_bytes(3, "big"), 31
+    if typ <= 7:
+        return bytes([typ << 5 | size_bits]) + extra
+    return bytes([size_bits, typ - 7]) + extra
+
+
+def uint_bytes(v):
+    return v.to_bytes((v.bit_length() + 7) // 8, "big")
+
+
+def enc(v):
+    if isinstance(v, Ptr):
+        off = v.off
+        if off < 2048:
+            return bytes([1 << 5 | 0 << 3 | off >> 8, off & 0xFF])
+        if off < 2048 + 524288:
+            off -= 2048
+            return bytes([1 << 5 | 1 << 3 | off >> 16]) + (off & 0xFFFF).to_bytes(2, "big")
+        raise ValueError("pointer too far for the fixtures")
+    if isinstance(v, bool):
+        return ctrl(14, int(v))
+    if isinstance(v, U16):
+        return ctrl(5, len(uint_bytes(v))) + uint_bytes(v)
+    if isinstance(v, U32):
+        return ctrl(6, len(uint_bytes(v))) + uint_bytes(v)
+    if isinstance(v, U64):
+        return ctrl(9, len(uint_bytes(v))) + uint_bytes(v)
+    if isinstance(v, U128):
+        return ctrl(10, len(uint_bytes(v))) + uint_bytes(v)
+    if isinstance(v, I32):
+        return ctrl(8, 4) + struct.pack(">i", v)
+    if isinstance(v, F32):
+        return ctrl(15, 4) + struct.pack(">f", v)
+    if isinstance(v, float):
+        return ctrl(3, 8) + struct.pack(">d", v)
+    if isinstance(v, str):
+        b = v.encode()
+        return ctrl(2, len(b)) + b
+    if isinstance(v, bytes):
+        return ctrl(4, len(v)) + v
+    if isinstance(v, list):
+        return ctrl(11, len(v)) + b"".join(enc(e) for e in v)
+    if isinstance(v, dict):
+        out = ctrl(7, len(v))
+        for k, e in v.items():
+            out += (enc(k) if isinstance(k, Ptr) else enc(str(k))) + enc(e)
+        return out
+    raise TypeError(type(v))
+
+
+class Tree:
+    """A plain binary trie; leaves are None or a data offset."""
+
+    def __init__(self):
+        self.root = [None, None]
+
+    def insert(self, bits, leaf):
+        node = self.root
+        for i, b in enumerate(bits):
+            if i == len(bits) - 1:
+                node[b] = leaf
+                return
+            if not isinstance(node[b], list):
+                node[b] = [node[b], node[b]]  # split a covering leaf
+            node = node[b]
+
+    def node_at(self, bits):
+        node = self.root
+        for b in bits:
+            node = node[b]
+        return node
+
+    def link(self, bits, target):
+        """Points the record at bits to the node target (an alias)."""
+        node = self.root
+        for b in bits[:-1]:
+            if node[b] is None:
+                node[b] = [None, None]
+            node = node[b]
+        node[bits[-1]] = target
+
+
+def bits_of(net, ipv6_db):
+    net = ipaddress.ip_network(net)
+    if net.version == 4 and ipv6_db:
+        addr, plen = int(net.network_address), net.prefixlen + 96
+        width = 128
+    else:
+        addr, plen = int(net.network_address), net.prefixlen
+        width = net.max_prefixlen
+    return [(addr >> (width - 1 - i)) & 1 for i in range(plen)]
+
+
+def build(path, ip_version, record_size, entries, aliases):
+    """entries: (network, value or ("same", network)), in order."""
+    data = bytearray()
+    offsets = {}
+    tree = Tree()
+    for net, value in entries:
+        if isinstance(value, tuple):
+            off = offsets[value[1]]
+        else:
+            off = len(data)
+            data += enc(value)
+        offsets[net] = off
+        tree.insert(bits_of(net, ip_version == 6), ("data", off))
+    if ip_version == 6:
+        v4 = tree.node_at([0] * 96)
+        for net in aliases:
+            tree.link(bits_of(net, True), v4)
+
+    # Number the nodes in pre-order, the shared IPv4 node once.
+    nodes, index = [], {}
+
+    def number(node):
+        if id(node) in index:
+            return
+        index[id(node)] = len(nodes)
+        nodes.append(node)
+        for c in node:
+            if isinstance(c, list):
+                number(c)
+
+    number(tree.root)
+    count = len(nodes)
+
+    def record(c):
+        if c is None:
+            return count
+        if isinstance(c, list):
+            return index[id(c)]
+        return count + 16 + c[1]
+
+    out = bytearray()
+    for node in nodes:
+        left, right = record(node[0]), record(node[1])
+        if record_size == 24:
+            out += left.to_bytes(3, "big") + right.to_bytes(3, "big")
+        elif record_size == 28:
+            out += (left & 0xFFFFFF).to_bytes(3, "big")
+            out += bytes([(left >> 24) << 4 | right >> 24])
+            out += (right & 0xFFFFFF).to_bytes(3, "big")
+        else:
+            out += struct.pack(">II", left, right)
+    out += bytes(16) + data + MARKER
+    out += enc({
+        "node_count": U32(count),
+        "record_size": U16(record_size),
+        "ip_version": U16(ip_version),
+        "database_type": "Fixture",
+        "languages": ["en", "de"],
+        "binary_format_major_version": U16(2),
+        "binary_format_minor_version": U16(0),
+        "build_epoch": U64(1700000000),
+        "description": {"en": "Test fixture", "de": "Testdaten"},
+    })
+    with open(path, "wb") as f:
+        f.write(out)
+
+
+# Later values point into the first one: at its "name" key and at the
+# "Australia" string.
+first = enc({"name": "AU", "country": {"names": {"en": "Australia"}}, "asn": U32(13335)})
+name, australia = 1, first.index(enc("Australia"))
+
+build("testdata/fixture-ipv6-28.mmdb", 6, 28, [
+    ("1.0.0.0/24", {"name": "AU", "country": {"names": {"en": "Australia"}}, "asn": U32(13335)}),
+    ("1.0.1.0/24", ("same", "1.0.0.0/24")),
+    ("10.0.0.0/8", {
+        Ptr(name): "ten",
+        "i32": I32(-1),
+        "u16": U16(443),
+        "u64": U64(1 << 40),
+        "u128": U128(1 << 100),
+        "f32": F32(0.5),
+        "f64": 1.25,
+        "yes": True,
+        "no": False,
+        "raw": b"\xde\xad\xbe\xef",
+        "list": ["a", U16(0), []],
+        "long": "x" * 300,
+    }),
+    ("2001:db8::/32", {Ptr(name): "doc", "country": Ptr(australia)}),
+    ("2001:db8:8000::/33", {Ptr(name): "doc-hi"}),
+], aliases=["::ffff:0:0/96", "2002::/16"])
+
+build("testdata/fixture-ipv4-32.mmdb", 4, 32, [
+    ("0.0.0.0/1", {"half": U16(1)}),
+    ("192.0.2.0/24", {"half": U16(2)}),
+], aliases=[])
@@ -0,0 +1,144 @@
+package pytricia
+
+import "net/netip"
+
+// Txn stages a batch of writes against a Trie and makes them visible all
+// at once: readers see either none of the batch or all of it, never a
+// half-applied state. Begin one with Trie.Begin, then finish it with
+// exactly one Commit or Rollback. A Txn is meant for a single goroutine.
+//
+// Each staged write is checked immediately against the trie as of Begin
+// plus the writes staged before it, with the usual semantics: Add fails
+// if the prefix is present, Set and Delete fail if it is not. Commit
+// replays the batch onto whatever version is current at that point, so
+// writes made by others after Begin are kept; if one of them turned a
+// staged write into a conflict, Commit returns that error and publishes
+// nothing.
+type Txn[V any] struct {
+	t      *Trie[V]
+	base   *tree[V] // version the batch was staged against
+	view   *tree[V] // base plus every staged write
+	ops    []op[V]
+	events []Event[V] // what ops did to base, in order
+	done   bool
+}
+
+// Begin starts a transaction on the trie.
+func (t *Trie[V]) Begin() *Txn[V] {
+	base := t.load()
+	return &Txn[V]{t: t, base: base, view: base}
+}
+
+// Insert: stage an overwrite-or-create
+func (x *Txn[V]) Insert(cidr string, value V) error {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	return x.InsertPrefix(p, value)
+}
+
+// Set: stage an overwrite of a present CIDR
+func (x *Txn[V]) Set(cidr string, value V) error {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	return x.SetPrefix(p, value)
+}
+
+// Add: stage an insert of an absent CIDR
+func (x *Txn[V]) Add(cidr string, value V) error {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	return x.AddPrefix(p, value)
+}
+
+// Delete: stage the removal of a present CIDR
+func (x *Txn[V]) Delete(cidr string) error {
+	p, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	return x.DeletePrefix(p)
+}
+
+// InsertPrefix: Insert for a netip.Prefix
+func (x *Txn[V]) InsertPrefix(p netip.Prefix, value V) error {
+	return x.stage(func(tr *tree[V]) (*tree[V], Event[V], error) { return tr.put(p, value, upsert) })
+}
+
+// SetPrefix: Set for a netip.Prefix
+func (x *Txn[V]) SetPrefix(p netip.Prefix, value V) error {
+	return x.stage(func(tr *tree[V]) (*tree[V], Event[V], error) { return tr.put(p, value, update) })
+}
+
+// AddPrefix: Add for a netip.Prefix
+func (x *Txn[V]) AddPrefix(p netip.Prefix, value V) error {
+	return x.stage(func(tr *tree[V]) (*tree[V], Event[V], error) { return tr.put(p, value, create) })
+}
+
+// DeletePrefix: Delete for a netip.Prefix
+func (x *Txn[V]) DeletePrefix(p netip.Prefix) error {
+	return x.stage(func(tr *tree[V]) (*tree[V], Event[V], error) { return tr.del(p) })
+}
+
+// Commit publishes every staged write atomically. The transaction is
+// finished afterwards, whether or not Commit succeeded.
+func (x *Txn[V]) Commit() error {
+	if x.done {
+		return ErrTxnDone
+	}
+	x.done = true
+
+	t := x.t
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Nobody wrote since Begin: the staged view is the answer. Otherwise
+	// rebuild the batch on top of their writes.
+	next, events := x.view, x.events
+	if cur := t.load(); cur != x.base {
+		events = make([]Event[V], 0, len(x.ops))
+		for _, o := range x.ops {
+			var (
+				ev  Event[V]
+				err error
+			)
+			if cur, ev, err = o(cur); err != nil {
+				return err
+			}
+			events = append(events, ev)
+		}
+		next = cur
+	}
+
+	t.root.Store(next)
+	for _, ev := range events {
+		t.notify(ev)
+	}
+	return nil
+}
+
+// Rollback discards every staged write.
+func (x *Txn[V]) Rollback() {
+	x.done = true
+	x.ops, x.events, x.view = nil, nil, x.base
+}
+
+// stage checks op against the staged view and records it on success.
+func (x *Txn[V]) stage(o op[V]) error {
+	if x.done {
+		return ErrTxnDone
+	}
+	next, ev, err := o(x.view)
+	if err != nil {
+		return err
+	}
+	x.view = next
+	x.ops = append(x.ops, o)
+	x.events = append(x.events, ev)
+	return nil
+}